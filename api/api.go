@@ -0,0 +1,168 @@
+// The api pkg accepts measurements submitted directly as JSON.
+// It is intended for processes that do not produce a log drain
+// (e.g. batch jobs) but still want l2met's aggregation.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/parser"
+	"github.com/ryandotsmith/l2met/receiver"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A single submission. If Time is blank, the time at which
+// l2met received the request is used. Type is one of measurement,
+// counter, sample or histogram and defaults to measurement.
+//
+//	[{"name": "job.duration", "value": 4.2, "units": "s"},
+//	 {"name": "job.rows", "type": "counter", "values": [10, 20]}]
+type Metric struct {
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Value  *float64  `json:"value"`
+	Values []float64 `json:"values"`
+	Source string    `json:"source"`
+	// Seconds since the epoch.
+	Time  int64  `json:"time"`
+	Units string `json:"units"`
+}
+
+// Metrics older than the receiver's deadline are dropped.
+type response struct {
+	Accepted int `json:"accepted"`
+	Dropped  int `json:"dropped"`
+}
+
+type Handler struct {
+	recv        *receiver.Receiver
+	maxBodySize int64
+	clock       clock.Clock
+	Mchan       *metchan.Channel
+}
+
+func NewHandler(cfg *conf.D, r *receiver.Receiver) *Handler {
+	h := new(Handler)
+	h.recv = r
+	h.maxBodySize = cfg.MaxBodySize
+	h.clock = clock.Default(cfg.Clock)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer h.Mchan.Time("api.accept", time.Now())
+	if req.Method != "POST" {
+		fmt.Printf("error=%q\n", "Non post method received.")
+		http.Error(w, "Invalid Request", 400)
+		return
+	}
+	tok, creds, err := auth.ParseRequest(req)
+	if err != nil {
+		fmt.Printf("error=%s\n", err)
+		http.Error(w, "Invalid Auth.", 400)
+		return
+	}
+	user := strings.Split(creds, ":")[0]
+	defer h.Mchan.CountReq(user)
+	if !h.recv.AdmitTenant(w, user) {
+		return
+	}
+	defer h.recv.ReleaseTenant(user)
+	opts := req.URL.Query()
+	if err := parser.CheckOptions(opts); err != nil {
+		fmt.Printf("error=%q\n", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	body, err := receiver.ReadBody(req, h.maxBodySize)
+	if err != nil {
+		fmt.Printf("error=%q\n", err)
+		http.Error(w, err.Error(), receiver.BodyErrorCode(err))
+		return
+	}
+	var metrics []*Metric
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		fmt.Printf("at=api-decode error=%s\n", err)
+		http.Error(w, "Invalid JSON.", 400)
+		return
+	}
+	// Validate the entire payload before accepting any of it
+	// so that a client can safely retry a rejected request.
+	now := h.clock.Now()
+	buckets := make([]*bucket.Bucket, 0, len(metrics))
+	for i, m := range metrics {
+		b, err := buildBucket(m, tok, opts, now)
+		if err != nil {
+			msg := fmt.Sprintf("metric[%d]: %s", i, err)
+			fmt.Printf("at=api-validate error=%q\n", msg)
+			http.Error(w, msg, 422)
+			return
+		}
+		buckets = append(buckets, b)
+	}
+	res := new(response)
+	for _, b := range buckets {
+		if h.recv.ReceiveBucket(b) {
+			res.Accepted++
+		} else {
+			res.Dropped++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func buildBucket(m *Metric, tok string, opts map[string][]string, now time.Time) (*bucket.Bucket, error) {
+	if len(m.Name) == 0 {
+		return nil, errors.New("Missing name.")
+	}
+	switch m.Type {
+	case "":
+		m.Type = "measurement"
+	case "measurement", "counter", "sample", "histogram":
+	default:
+		return nil, errors.New("Unknown type: " + m.Type)
+	}
+	vals := m.Values
+	if m.Value != nil {
+		vals = append([]float64{*m.Value}, vals...)
+	}
+	if len(vals) == 0 {
+		return nil, errors.New("Missing value.")
+	}
+	t := now
+	if m.Time > 0 {
+		t = time.Unix(m.Time, 0)
+	}
+	id := new(bucket.Id)
+	id.Resolution = parser.Resolution(opts)
+	id.Time = t.Truncate(id.Resolution)
+	id.ReadyAt = id.Time.Add(id.Resolution)
+	id.Auth = tok
+	id.Name = parser.Prefix(opts, m.Name)
+	id.Units = m.Units
+	id.Source = parser.SourcePrefix(opts, m.Source)
+	id.Type = m.Type
+	// The options have been checked by ServeHTTP.
+	id.Percentiles, _ = parser.Percentiles(opts)
+	id.PercentileMethod, _ = parser.PercentileMethod(opts)
+	id.Mean, _ = parser.Mean(opts)
+	id.Rate, _ = parser.Rate(opts)
+	if id.Type != "histogram" {
+		return &bucket.Bucket{Id: id, Vals: vals}, nil
+	}
+	id.Bounds, _ = parser.Bounds(opts)
+	b := &bucket.Bucket{Id: id}
+	for _, v := range vals {
+		b.Observe(v)
+	}
+	return b, nil
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/receiver"
+	"github.com/ryandotsmith/l2met/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func val(f float64) *float64 {
+	return &f
+}
+
+var buildTest = []struct {
+	desc  string
+	in    *Metric
+	opts  map[string][]string
+	name  string
+	typ   string
+	vals  int
+	isErr bool
+}{
+	{
+		"default type",
+		&Metric{Name: "a", Value: val(1)},
+		nil, "a", "measurement", 1, false,
+	},
+	{
+		"value and values",
+		&Metric{Name: "a", Type: "counter", Value: val(1), Values: []float64{2, 3}},
+		nil, "a", "counter", 3, false,
+	},
+	{
+		"prefix",
+		&Metric{Name: "a", Type: "sample", Values: []float64{2}},
+		map[string][]string{"prefix": []string{"pre"}}, "pre.a", "sample", 1, false,
+	},
+	{
+		"histogram",
+		&Metric{Name: "a", Type: "histogram", Values: []float64{2, 3}},
+		nil, "a", "histogram", 0, false,
+	},
+	{"missing name", &Metric{Value: val(1)}, nil, "", "", 0, true},
+	{"missing value", &Metric{Name: "a"}, nil, "", "", 0, true},
+	{"bad type", &Metric{Name: "a", Type: "x", Value: val(1)}, nil, "", "", 0, true},
+}
+
+func TestBuildBucket(t *testing.T) {
+	now := time.Now()
+	for _, ts := range buildTest {
+		b, err := buildBucket(ts.in, "tok", ts.opts, now)
+		if ts.isErr {
+			if err == nil {
+				t.Errorf("case=%s expected error\n", ts.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case=%s error=%s\n", ts.desc, err)
+			continue
+		}
+		if b.Id.Name != ts.name || b.Id.Type != ts.typ || len(b.Vals) != ts.vals {
+			t.Errorf("case=%s actual-name=%s actual-type=%s actual-vals=%v\n",
+				ts.desc, b.Id.Name, b.Id.Type, b.Vals)
+		}
+		if !b.Id.Time.Equal(now.Truncate(time.Minute)) {
+			t.Errorf("case=%s actual-time=%s\n", ts.desc, b.Id.Time)
+		}
+	}
+}
+
+func TestBuildBucketOptions(t *testing.T) {
+	opts := map[string][]string{
+		"percentiles":       []string{"50,99"},
+		"percentile-method": []string{"linear"},
+		"mean":              []string{"true"},
+		"rate":              []string{"also"},
+		"bounds":            []string{"10,100"},
+	}
+	m := &Metric{Name: "a", Type: "histogram", Values: []float64{5, 50}}
+	b, err := buildBucket(m, "tok", opts, time.Now())
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	id := b.Id
+	if id.Percentiles != "50,99" || id.PercentileMethod != "linear" ||
+		!id.Mean || id.Rate != "also" || id.Bounds != "10,100" {
+		t.Fatalf("actual=%+v\n", id)
+	}
+	if b.Hist == nil || b.Hist.Count() != 2 {
+		t.Fatalf("actual-hist=%+v expected 2 values\n", b.Hist)
+	}
+}
+
+func newTestHandler(tenantInFlight int) (*Handler, *receiver.Receiver) {
+	cfg := &conf.D{
+		Concurrency:      1,
+		BufferSize:       10,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+		TenantInFlight:   tenantInFlight,
+	}
+	r := receiver.NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	h := NewHandler(cfg, r)
+	h.Mchan = new(metchan.Channel)
+	return h, r
+}
+
+func post(t *testing.T, h *Handler, path, creds, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "http://l2met.net"+path, bytes.NewBufferString(body))
+	if len(creds) > 0 {
+		tok, err := auth.EncryptAndSign([]byte(creds))
+		if err != nil {
+			t.Fatalf("Must set $SECRETS error=%s\n", err)
+		}
+		hdr := "Basic " + base64.URLEncoding.EncodeToString(append(tok, ':'))
+		req.Header.Set("Authorization", hdr)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+var serveTest = []struct {
+	desc  string
+	path  string
+	creds string
+	body  string
+	code  int
+}{
+	{"missing auth", "/api", "", `[]`, 400},
+	{"bad option", "/api?percentiles=200", "u:p", `[]`, 400},
+	{"bad json", "/api", "u:p", `{`, 400},
+	{"missing value", "/api", "u:p", `[{"name": "a"}]`, 422},
+	{"ok", "/api?mean=true", "u:p", `[{"name": "a", "value": 1}]`, 200},
+}
+
+func TestServeHTTP(t *testing.T) {
+	h, r := newTestHandler(0)
+	defer r.Stop()
+	for _, ts := range serveTest {
+		w := post(t, h, ts.path, ts.creds, ts.body)
+		if w.Code != ts.code {
+			t.Errorf("case=%s actual-code=%d expected-code=%d\n", ts.desc, w.Code, ts.code)
+		}
+	}
+}
+
+func TestServeHTTPTenantLimit(t *testing.T) {
+	h, r := newTestHandler(1)
+	defer r.Stop()
+	if !r.AdmitTenant(httptest.NewRecorder(), "u") {
+		t.Fatalf("Expected the first request to be admitted.\n")
+	}
+	w := post(t, h, "/api", "u:p", `[{"name": "a", "value": 1}]`)
+	if w.Code != 429 {
+		t.Fatalf("actual-code=%d expected-code=429\n", w.Code)
+	}
+	r.ReleaseTenant("u")
+	w = post(t, h, "/api", "u:p", `[{"name": "a", "value": 1}]`)
+	if w.Code != 200 {
+		t.Fatalf("actual-code=%d expected-code=200\n", w.Code)
+	}
+}
+
+func TestServeHTTPCounts(t *testing.T) {
+	h, r := newTestHandler(0)
+	defer r.Stop()
+	// The second metric is past the receiver's deadline.
+	body := `[{"name": "a", "value": 1}, {"name": "b", "value": 1, "time": 1}]`
+	w := post(t, h, "/api", "u:p", body)
+	if w.Code != 200 {
+		t.Fatalf("actual-code=%d expected-code=200\n", w.Code)
+	}
+	res := new(response)
+	if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if res.Accepted != 1 || res.Dropped != 1 {
+		t.Fatalf("actual=%+v expected=accepted:1,dropped:1\n", res)
+	}
+}
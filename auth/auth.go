@@ -57,6 +57,26 @@ func Parse(authLine string) (string, error) {
 	return strings.TrimSuffix(string(decodedPayload), ":"), nil
 }
 
+// Extracts the encrypted credentials from the authorization
+// header of an HTTP request. If we can decrypt the credentials
+// we know they are valid. Returns the encrypted credentials
+// and the decrypted user:pass.
+func ParseRequest(r *http.Request) (string, string, error) {
+	l := r.Header.Get("Authorization")
+	if len(l) == 0 {
+		return "", "", errors.New("Missing authorization header.")
+	}
+	tok, err := Parse(l)
+	if err != nil {
+		return "", "", err
+	}
+	creds, err := Decrypt(tok)
+	if err != nil {
+		return "", "", err
+	}
+	return tok, creds, nil
+}
+
 func Decrypt(s string) (string, error) {
 	msg := fernet.VerifyAndDecrypt([]byte(s), ttl, keys)
 	if msg == nil {
@@ -57,6 +57,24 @@ func testEncryptDecrypt(t *testing.T, ts authTest) {
 	if actualOutput != ts.output {
 		t.Fatalf("actual=%q expected=%q\n", actualOutput, ts.output)
 	}
+
+	_, creds, err := ParseRequest(r)
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if creds != ts.output {
+		t.Fatalf("actual=%q expected=%q\n", creds, ts.output)
+	}
+}
+
+func TestParseRequestMissingAuth(t *testing.T) {
+	r, err := http.NewRequest("POST", "http://does-not-matter.com", nil)
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if _, _, err := ParseRequest(r); err == nil {
+		t.Fatalf("Expected missing authorization error.\n")
+	}
 }
 
 var parseTests = []struct {
@@ -5,6 +5,7 @@ import (
 	"github.com/ryandotsmith/l2met/metchan"
 	"github.com/ryandotsmith/l2met/receiver"
 	"github.com/ryandotsmith/l2met/store"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -32,7 +33,9 @@ func BenchmarkReceive(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		msg := fmt.Sprintf(bmsg, time.Now().Format(tf))
 		b.StartTimer()
-		recv.Receive([]byte(msg), opts)
+		for recv.Receive([]byte(msg), opts) != nil {
+			runtime.Gosched()
+		}
 		b.StopTimer()
 		b.SetBytes(int64(len(msg)))
 	}
@@ -2,6 +2,8 @@
 package bucket
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"sort"
@@ -33,39 +35,212 @@ type LibratoMetric struct {
 	Attr   *libratoAttrs `json:"attributes,omitempty"`
 }
 
+// Buckets keep up to ExactValues raw values. Beyond that the
+// values are folded into a Sketch so that the memory of a bucket
+// does not grow with the number of values it has seen.
+var ExactValues = 128
+
+// The version of the encoding written by EncodeVals. Values
+// stored as float strings, before the encoding, do not start
+// with this byte and are left to the store to parse.
+const valsEncoding = 1
+
 type Bucket struct {
 	sync.Mutex
-	Id   *Id
-	Vals []float64
-	Sum  float64
+	Id *Id
+	// Values that have not been folded into the sketch.
+	Vals   []float64
+	Sketch *Sketch
+	// The distinct values of a unique bucket.
+	Uniques *HLL
+	// The counts of a histogram bucket.
+	Hist *Histogram
 }
 
 func (b *Bucket) Reset() {
 	b.Lock()
 	defer b.Unlock()
-	b.Sum = 0
 	b.Vals = b.Vals[:0]
+	b.Sketch = nil
+	b.Uniques = nil
+	b.Hist = nil
 }
 
 func (b *Bucket) Append(val float64) {
 	b.Lock()
 	defer b.Unlock()
-	b.Sum += val
-	b.Vals = append(b.Vals, val)
+	b.append(val)
+}
+
+// Records val as n values. Once n outgrows the raw values the
+// value is added to the sketch once with a weight of n, so the
+// memory used does not depend on n.
+func (b *Bucket) AppendN(val float64, n int) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.Vals)+n <= ExactValues {
+		for i := 0; i < n; i++ {
+			b.Vals = append(b.Vals, val)
+		}
+		return
+	}
+	b.fold()
+	b.Sketch.addN(val, uint64(n))
+	b.Sketch.last = val
 }
 
-func (b *Bucket) Incr(val float64) {
+func (b *Bucket) AddUnique(v []byte) {
 	b.Lock()
 	defer b.Unlock()
-	b.Sum += val
+	if b.Uniques == nil {
+		b.Uniques = NewHLL(HLLPrecision)
+	}
+	b.Uniques.Add(v)
+}
+
+// Counts the value into the histogram bounds of the bucket's id.
+func (b *Bucket) Observe(v float64) {
+	b.Lock()
+	defer b.Unlock()
+	if b.Hist == nil {
+		b.Hist = NewHistogram(b.Id.BoundList())
+	}
+	b.Hist.Observe(v)
+}
+
+func (b *Bucket) append(val float64) {
+	b.Vals = append(b.Vals, val)
+	if len(b.Vals) > ExactValues {
+		b.fold()
+	}
+}
+
+// Moves the raw values into the sketch.
+func (b *Bucket) fold() {
+	if b.Sketch == nil {
+		b.Sketch = NewSketch(Accuracy)
+	}
+	for _, v := range b.Vals {
+		b.Sketch.Add(v)
+	}
+	b.Vals = b.Vals[:0]
+}
+
+// Returns the sketch holding all of the values or nil
+// if the bucket has not outgrown its raw values.
+func (b *Bucket) sketch() *Sketch {
+	if b.Sketch != nil && len(b.Vals) > 0 {
+		b.fold()
+	}
+	return b.Sketch
 }
 
 func (b *Bucket) Merge(other *Bucket) {
 	other.Lock()
 	defer other.Unlock()
+	b.Lock()
+	defer b.Unlock()
+	if other.Sketch != nil {
+		// Fold our values first so that the order
+		// of the values, and thus Last, is kept.
+		b.fold()
+		b.Sketch.Merge(other.Sketch)
+	}
 	for _, v := range other.Vals {
-		b.Append(v)
+		b.append(v)
+	}
+	if other.Uniques != nil {
+		if b.Uniques == nil {
+			b.Uniques = NewHLL(HLLPrecision)
+		}
+		b.Uniques.Merge(other.Uniques)
+	}
+	if other.Hist != nil {
+		if b.Hist == nil {
+			b.Hist = NewHistogram(other.Hist.Bounds())
+		}
+		b.Hist.Merge(other.Hist)
+	}
+}
+
+// Encodes the raw values and the sketch of the bucket.
+// The id is not included.
+func (b *Bucket) EncodeVals() []byte {
+	b.Lock()
+	defer b.Unlock()
+	buf := new(bytes.Buffer)
+	buf.WriteByte(valsEncoding)
+	writeUvarint(buf, uint64(len(b.Vals)))
+	for _, v := range b.Vals {
+		writeFloat(buf, v)
+	}
+	if b.Sketch == nil {
+		buf.WriteByte(0)
+	} else {
+		buf.WriteByte(1)
+		b.Sketch.encode(buf)
+	}
+	if b.Uniques == nil {
+		buf.WriteByte(0)
+	} else {
+		buf.WriteByte(1)
+		b.Uniques.encode(buf)
 	}
+	if b.Hist == nil {
+		buf.WriteByte(0)
+	} else {
+		buf.WriteByte(1)
+		b.Hist.encode(buf)
+	}
+	return buf.Bytes()
+}
+
+// Merges values written by EncodeVals into the bucket.
+func (b *Bucket) MergeEncoded(p []byte) error {
+	buf := bytes.NewReader(p)
+	version, err := buf.ReadByte()
+	if err != nil || version != valsEncoding {
+		return ErrSketchEncoding
+	}
+	n, err := binary.ReadUvarint(buf)
+	if err != nil || n > uint64(buf.Len()/8) {
+		return ErrSketchEncoding
+	}
+	other := &Bucket{Vals: make([]float64, n)}
+	for i := range other.Vals {
+		if other.Vals[i], err = readFloat(buf); err != nil {
+			return err
+		}
+	}
+	hasSketch, err := buf.ReadByte()
+	if err != nil {
+		return ErrSketchEncoding
+	}
+	if hasSketch == 1 {
+		if other.Sketch, err = decodeSketch(buf); err != nil {
+			return err
+		}
+	}
+	hasUniques, err := buf.ReadByte()
+	if err != nil {
+		return ErrSketchEncoding
+	}
+	if hasUniques == 1 {
+		if other.Uniques, err = decodeHLL(buf); err != nil {
+			return err
+		}
+	}
+	hasHist, err := buf.ReadByte()
+	if err != nil {
+		return ErrSketchEncoding
+	}
+	if hasHist == 1 {
+		if other.Hist, err = decodeHistogram(buf); err != nil {
+			return err
+		}
+	}
+	b.Merge(other)
+	return nil
 }
 
 // Relies on the Emitter to determine which type of
@@ -78,28 +253,87 @@ func (b *Bucket) Metrics() []*LibratoMetric {
 		return b.EmitCounters()
 	case "sample":
 		return b.EmitSamples()
+	case "unique":
+		return b.EmitUniques()
+	case "histogram":
+		return b.EmitHistogram()
+	case "total":
+		// Totals are converted to counters by store.Deltas.
+		// A total on its own has nothing to emit.
+		return nil
 	default:
 		panic("Undefined bucket.Id type.")
 	}
 }
 
 // The standard emitter. All log data with `measure.foo` will
-// be mapped to the MeasureEmitter.
+// be mapped to the MeasureEmitter. A metric is emitted for
+// each of the percentiles requested on the bucket's id.
 func (b *Bucket) EmitMeasurements() []*LibratoMetric {
-	metrics := make([]*LibratoMetric, 4)
+	ps := b.Id.PercentileList()
+	metrics := make([]*LibratoMetric, 1, len(ps)+1)
 	metrics[0] = b.ComplexMetric()
-	metrics[1] = b.Metric(".median", b.Median())
-	metrics[2] = b.Metric(".perc95", b.Perc95())
-	metrics[3] = b.Metric(".perc99", b.Perc99())
+	for _, p := range ps {
+		metrics = append(metrics, b.Metric(PercentileSuffix(p), b.Percentile(p)))
+	}
+	metrics = append(metrics, b.Metric(".stddev", b.StdDev()))
+	// The variance is in the square of the bucket's units.
+	variance := b.Metric(".variance", b.Variance())
+	if len(b.Id.Units) > 0 {
+		variance.Attr.Units = b.Id.Units + "^2"
+	}
+	metrics = append(metrics, variance)
+	if b.Id.Mean {
+		metrics = append(metrics, b.Metric(".mean", b.Mean()))
+	}
 	return metrics
 }
 
+// Emits the sum and, if the bucket's id asks for it,
+// the per-second rate as a .rate series.
 func (b *Bucket) EmitCounters() []*LibratoMetric {
-	metrics := make([]*LibratoMetric, 1)
-	metrics[0] = b.Metric("", b.Sum)
+	metrics := make([]*LibratoMetric, 0, 2)
+	if b.Id.Rate != RateOnly {
+		metrics = append(metrics, b.Metric("", b.Sum()))
+	}
+	if b.Id.Rate == RateAlso || b.Id.Rate == RateOnly {
+		// E.g. a counter of requests has a rate in requests/s.
+		rate := b.Metric(".rate", b.Rate())
+		units := b.Id.Units
+		if len(units) == 0 {
+			units = "count"
+		}
+		rate.Attr.Units = units + "/s"
+		metrics = append(metrics, rate)
+	}
 	return metrics
 }
 
+// Emits the number of values less than or equal to each bound
+// and the number of all values as .le_inf. E.g. the fraction of
+// requests served within 300ms is x.le_300 / x.le_inf.
+func (b *Bucket) EmitHistogram() []*LibratoMetric {
+	h := b.Hist
+	if h == nil {
+		h = NewHistogram(b.Id.BoundList())
+	}
+	metrics := make([]*LibratoMetric, 0, len(h.Bounds())+1)
+	for i, n := range h.Cumulative() {
+		suffix := BoundSuffix(h.Bounds()[i])
+		metrics = append(metrics, b.Metric(suffix, float64(n)))
+	}
+	return append(metrics, b.Metric(".le_inf", float64(h.Count())))
+}
+
+// Emits the number of distinct values as a gauge.
+func (b *Bucket) EmitUniques() []*LibratoMetric {
+	var n uint64
+	if b.Uniques != nil {
+		n = b.Uniques.Count()
+	}
+	return []*LibratoMetric{b.Metric("", float64(n))}
+}
+
 func (b *Bucket) EmitSamples() []*LibratoMetric {
 	metrics := make([]*LibratoMetric, 1)
 	metrics[0] = b.Metric("", b.Last())
@@ -110,7 +344,7 @@ func (b *Bucket) ComplexMetric() *LibratoMetric {
 	min := b.Min()
 	max := b.Max()
 	cnt := b.Count()
-	sum := b.Sum
+	sum := b.Sum()
 	return &LibratoMetric{
 		Attr: &libratoAttrs{
 			Min:   0,
@@ -144,19 +378,75 @@ func (b *Bucket) Metric(suffix string, val float64) *LibratoMetric {
 }
 
 func (b *Bucket) String() string {
+	if b.Sketch != nil {
+		return fmt.Sprintf("name=%s source=%s vals=%v count=%d",
+			b.Id.Name, b.Id.Source, b.Vals, b.Count())
+	}
 	return fmt.Sprintf("name=%s source=%s vals=%v",
 		b.Id.Name, b.Id.Source, b.Vals)
 }
 
+// An estimate of the memory held by the bucket, measured in
+// values (8 bytes). Sketch bins hold a key and a count. A unique
+// bucket may hold many registers while counting a few values.
+func (b *Bucket) Size() int {
+	n := len(b.Vals)
+	if b.Sketch != nil {
+		n += 2 * b.Sketch.Size()
+	}
+	if b.Uniques != nil {
+		n += len(b.Uniques.hashes) + len(b.Uniques.regs)/8
+	}
+	if b.Hist != nil {
+		n += len(b.Hist.bounds) + len(b.Hist.counts)
+	}
+	return n
+}
+
 func (b *Bucket) Count() int {
-	return len(b.Vals)
+	n := len(b.Vals)
+	if b.Sketch != nil {
+		n += b.Sketch.Count()
+	}
+	return n
+}
+
+func (b *Bucket) Sum() float64 {
+	var sum float64
+	for _, v := range b.Vals {
+		sum += v
+	}
+	if b.Sketch != nil {
+		sum += b.Sketch.Sum()
+	}
+	return sum
 }
 
 func (b *Bucket) Mean() float64 {
 	if b.Count() == 0 {
 		return float64(0)
 	}
-	return b.Sum / float64(b.Count())
+	return b.Sum() / float64(b.Count())
+}
+
+// The population variance of the values.
+func (b *Bucket) Variance() float64 {
+	if b.Count() == 0 {
+		return float64(0)
+	}
+	if s := b.sketch(); s != nil {
+		return s.Variance()
+	}
+	mean := b.Mean()
+	var m2 float64
+	for _, v := range b.Vals {
+		m2 += (v - mean) * (v - mean)
+	}
+	return m2 / float64(b.Count())
+}
+
+func (b *Bucket) StdDev() float64 {
+	return math.Sqrt(b.Variance())
 }
 
 func (b *Bucket) Sort() {
@@ -169,50 +459,75 @@ func (b *Bucket) Min() float64 {
 	if b.Count() == 0 {
 		return float64(0)
 	}
+	if s := b.sketch(); s != nil {
+		return s.Min()
+	}
 	b.Sort()
 	return b.Vals[0]
 }
 
 func (b *Bucket) Median() float64 {
-	if b.Count() == 0 {
-		return float64(0)
-	}
-	b.Sort()
-	pos := int(math.Ceil(float64(b.Count() / 2)))
-	return b.Vals[pos]
+	return b.Percentile(50)
 }
 
 func (b *Bucket) Perc95() float64 {
-	if b.Count() == 0 {
-		return float64(0)
-	}
-	b.Sort()
-	pos := int(math.Floor(float64(b.Count()) * 0.95))
-	return b.Vals[pos]
+	return b.Percentile(95)
 }
 
 func (b *Bucket) Perc99() float64 {
-	if b.Count() == 0 {
-		return float64(0)
+	return b.Percentile(99)
+}
+
+// Where p is in [0, 100]. Uses the method named by the bucket's id.
+func (b *Bucket) Percentile(p float64) float64 {
+	method := b.Id.PercentileMethod
+	if len(method) == 0 {
+		method = DefaultPercentileMethod
+	}
+	if s := b.sketch(); s != nil {
+		return percentile(method, p, s.Count(), s.ValueAt)
 	}
 	b.Sort()
-	pos := int(math.Floor(float64(b.Count()) * 0.99))
-	return b.Vals[pos]
+	return percentile(method, p, len(b.Vals), func(i int) float64 {
+		return b.Vals[i]
+	})
 }
 
 func (b *Bucket) Max() float64 {
 	if b.Count() == 0 {
 		return float64(0)
 	}
+	if s := b.sketch(); s != nil {
+		return s.Max()
+	}
 	b.Sort()
 	pos := b.Count() - 1
 	return b.Vals[pos]
 }
 
 func (b *Bucket) Last() float64 {
-	if b.Count() == 0 {
+	if len(b.Vals) == 0 {
+		if b.Sketch != nil {
+			return b.Sketch.Last()
+		}
 		return float64(0)
 	}
-	pos := b.Count() - 1
+	pos := len(b.Vals) - 1
 	return b.Vals[pos]
 }
+
+// Orders buckets by time, name and source.
+type ByTime []*Bucket
+
+func (b ByTime) Len() int      { return len(b) }
+func (b ByTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b ByTime) Less(i, j int) bool {
+	x, y := b[i].Id, b[j].Id
+	if !x.Time.Equal(y.Time) {
+		return x.Time.Before(y.Time)
+	}
+	if x.Name != y.Name {
+		return x.Name < y.Name
+	}
+	return x.Source < y.Source
+}
@@ -0,0 +1,177 @@
+package bucket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrBounds = errors.New("Bounds must be a list of at most 32 numbers.")
+
+// Used for histograms when a drain does not give bounds.
+// Suited to latencies in milliseconds.
+var DefaultBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const maxBounds = 32
+
+// Parses a comma separated list such as "100,300,1000".
+// The bounds are returned sorted and without duplicates.
+func ParseBounds(s string) ([]float64, error) {
+	var bs []float64
+	seen := make(map[float64]bool)
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || math.IsNaN(b) || math.IsInf(b, 0) {
+			return nil, ErrBounds
+		}
+		if !seen[b] {
+			seen[b] = true
+			bs = append(bs, b)
+		}
+	}
+	if len(bs) > maxBounds {
+		return nil, ErrBounds
+	}
+	sort.Float64s(bs)
+	return bs, nil
+}
+
+// The form of the bounds that is kept on the bucket.Id.
+func FormatBounds(bs []float64) string {
+	s := make([]string, len(bs))
+	for i, b := range bs {
+		s[i] = strconv.FormatFloat(b, 'f', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+// The suffix of the metric that counts the values less
+// than or equal to bound b. E.g. .le_300 and .le_0_5
+func BoundSuffix(b float64) string {
+	s := strconv.FormatFloat(b, 'f', -1, 64)
+	return ".le_" + strings.Replace(strings.Replace(s, ".", "_", 1), "-", "neg", 1)
+}
+
+// Counts values into fixed bins. Unlike a sketch, the counts
+// are exact, so histograms merge exactly across receivers.
+type Histogram struct {
+	bounds []float64
+	// counts[i] holds the values in (bounds[i-1], bounds[i]].
+	// The last count holds the values above every bound.
+	counts []uint64
+	sum    float64
+}
+
+// The bounds must be sorted.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Bounds() []float64 { return h.bounds }
+func (h *Histogram) Sum() float64      { return h.sum }
+
+func (h *Histogram) Observe(v float64) {
+	h.observeN(v, 1)
+}
+
+func (h *Histogram) observeN(v float64, n uint64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)] += n
+	h.sum += v * float64(n)
+}
+
+func (h *Histogram) Count() uint64 {
+	var n uint64
+	for _, c := range h.counts {
+		n += c
+	}
+	return n
+}
+
+// The number of values less than or equal to each bound.
+func (h *Histogram) Cumulative() []uint64 {
+	out := make([]uint64, len(h.bounds))
+	var n uint64
+	for i := range h.bounds {
+		n += h.counts[i]
+		out[i] = n
+	}
+	return out
+}
+
+// Buckets with the same id have the same bounds. Should the
+// bounds differ (e.g. DefaultBounds changed), the values of
+// other are counted at the upper bound of the bin they were in.
+func (h *Histogram) Merge(other *Histogram) {
+	if equalBounds(h.bounds, other.bounds) {
+		for i, c := range other.counts {
+			h.counts[i] += c
+		}
+		h.sum += other.sum
+		return
+	}
+	sum := h.sum + other.sum
+	for i, c := range other.counts {
+		v := math.Inf(1)
+		if i < len(other.bounds) {
+			v = other.bounds[i]
+		}
+		h.counts[sort.SearchFloat64s(h.bounds, v)] += c
+	}
+	h.sum = sum
+}
+
+func equalBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Histogram) encode(buf *bytes.Buffer) {
+	writeUvarint(buf, uint64(len(h.bounds)))
+	for _, b := range h.bounds {
+		writeFloat(buf, b)
+	}
+	for _, c := range h.counts {
+		writeUvarint(buf, c)
+	}
+	writeFloat(buf, h.sum)
+}
+
+func decodeHistogram(buf *bytes.Reader) (*Histogram, error) {
+	n, err := binary.ReadUvarint(buf)
+	if err != nil || n > maxBounds {
+		return nil, ErrSketchEncoding
+	}
+	bounds := make([]float64, n)
+	for i := range bounds {
+		if bounds[i], err = readFloat(buf); err != nil {
+			return nil, err
+		}
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		return nil, ErrSketchEncoding
+	}
+	h := NewHistogram(bounds)
+	for i := range h.counts {
+		if h.counts[i], err = binary.ReadUvarint(buf); err != nil {
+			return nil, ErrSketchEncoding
+		}
+	}
+	if h.sum, err = readFloat(buf); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,84 @@
+package bucket
+
+import (
+	"testing"
+)
+
+var boundsTest = []struct {
+	in  string
+	out string
+	err error
+}{
+	{"300,100,1000", "100,300,1000", nil},
+	{"0.5, 1,1", "0.5,1", nil},
+	{"-10,0", "-10,0", nil},
+	{"100,", "", ErrBounds},
+	{"Inf", "", ErrBounds},
+	{"fast", "", ErrBounds},
+}
+
+func TestParseBounds(t *testing.T) {
+	for _, ts := range boundsTest {
+		bs, err := ParseBounds(ts.in)
+		if err != ts.err || FormatBounds(bs) != ts.out {
+			t.Fatalf("in=%q actual=%q,%v expected=%q,%v\n",
+				ts.in, FormatBounds(bs), err, ts.out, ts.err)
+		}
+	}
+}
+
+func TestEmitHistogram(t *testing.T) {
+	id := &Id{Name: "lat", Type: "histogram", Bounds: "100,300,0.5"}
+	a, b := &Bucket{Id: id}, &Bucket{Id: id}
+	// A value equal to a bound is counted in that bound.
+	for _, v := range []float64{0.1, 100, 250} {
+		a.Observe(v)
+	}
+	for _, v := range []float64{300, 301, 5000} {
+		b.Observe(v)
+	}
+	// Receivers write their histograms to the store,
+	// which merges them for the reader.
+	merged := &Bucket{Id: id}
+	for _, x := range []*Bucket{a, b} {
+		if err := merged.MergeEncoded(x.EncodeVals()); err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+	}
+	expected := []struct {
+		name string
+		val  float64
+	}{
+		{"lat.le_0_5", 1},
+		{"lat.le_100", 2},
+		{"lat.le_300", 4},
+		{"lat.le_inf", 6},
+	}
+	metrics := merged.Metrics()
+	if len(metrics) != len(expected) {
+		t.Fatalf("actual-len=%d expected-len=%d\n", len(metrics), len(expected))
+	}
+	for i, m := range metrics {
+		if m.Name != expected[i].name || *m.Val != expected[i].val {
+			t.Fatalf("actual=%s,%f expected=%s,%f\n",
+				m.Name, *m.Val, expected[i].name, expected[i].val)
+		}
+	}
+	if merged.Hist.Sum() != 5951.1 {
+		t.Fatalf("actual-sum=%f expected-sum=5951.1\n", merged.Hist.Sum())
+	}
+}
+
+func TestMergeHistogramBounds(t *testing.T) {
+	h := NewHistogram([]float64{10, 100})
+	other := NewHistogram([]float64{5, 50, 500})
+	for _, v := range []float64{1, 40, 400, 4000} {
+		other.Observe(v)
+	}
+	h.Merge(other)
+	c := h.Cumulative()
+	// 1 is counted at 5, 40 at 50 and 400 at 500.
+	if c[0] != 1 || c[1] != 2 || h.Count() != 4 {
+		t.Fatalf("actual=%v,%d expected=[1 2],4\n", c, h.Count())
+	}
+}
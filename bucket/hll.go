@@ -0,0 +1,254 @@
+package bucket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// The number of registers of new HLLs is 2^HLLPrecision. The
+// standard error of a count is 1.04/sqrt(2^HLLPrecision), which
+// is 0.8% for the default of 14 and 16KB of registers.
+var HLLPrecision = 14
+
+// An HLL keeps the hashes of up to this many values and
+// counts them exactly before it switches to registers.
+const hllExact = 256
+
+// Encodings of the registers.
+const (
+	hllHashes = iota
+	hllSparse
+	hllDense
+)
+
+// A mergeable count of distinct values (HyperLogLog). Small sets
+// are counted exactly from the hashes of their values.
+type HLL struct {
+	p      uint8
+	hashes map[uint64]struct{}
+	// Allocated when the hashes outgrow hllExact.
+	regs []uint8
+}
+
+// Uses HLLPrecision if p is not in [4, 18].
+func NewHLL(p int) *HLL {
+	if p < 4 || p > 18 {
+		p = HLLPrecision
+	}
+	return &HLL{p: uint8(p), hashes: make(map[uint64]struct{})}
+}
+
+func (h *HLL) Add(v []byte) {
+	h.addHash(hash64(v))
+}
+
+func (h *HLL) addHash(x uint64) {
+	if h.regs == nil {
+		h.hashes[x] = struct{}{}
+		if len(h.hashes) > hllExact {
+			h.toRegisters()
+		}
+		return
+	}
+	i, r := h.register(x)
+	if r > h.regs[i] {
+		h.regs[i] = r
+	}
+}
+
+// The top p bits of the hash pick the register. The register
+// keeps the largest position of the first 1 in the rest.
+func (h *HLL) register(x uint64) (uint64, uint8) {
+	i := x >> (64 - h.p)
+	w := x<<h.p | 1<<(h.p-1)
+	return i, uint8(bits.LeadingZeros64(w) + 1)
+}
+
+func (h *HLL) toRegisters() {
+	h.regs = make([]uint8, 1<<h.p)
+	for x := range h.hashes {
+		i, r := h.register(x)
+		if r > h.regs[i] {
+			h.regs[i] = r
+		}
+	}
+	h.hashes = nil
+}
+
+// The estimated number of distinct values.
+func (h *HLL) Count() uint64 {
+	if h.regs == nil {
+		return uint64(len(h.hashes))
+	}
+	m := float64(len(h.regs))
+	var sum float64
+	var zeros int
+	for _, r := range h.regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Linear counting is more accurate for small counts.
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// Adds the values of other to h. If other has fewer registers,
+// h is folded to other's precision.
+func (h *HLL) Merge(other *HLL) {
+	if other.regs == nil {
+		for x := range other.hashes {
+			h.addHash(x)
+		}
+		return
+	}
+	if h.regs == nil {
+		h.toRegisters()
+	}
+	if other.p < h.p {
+		h.regs = fold(h.regs, h.p, other.p)
+		h.p = other.p
+	}
+	regs := other.regs
+	if other.p > h.p {
+		regs = fold(other.regs, other.p, h.p)
+	}
+	for i, r := range regs {
+		if r > h.regs[i] {
+			h.regs[i] = r
+		}
+	}
+}
+
+// Converts registers of precision from to precision to. The bits
+// of the index that are dropped become the start of the rank.
+func fold(regs []uint8, from, to uint8) []uint8 {
+	d := from - to
+	out := make([]uint8, 1<<to)
+	for i, r := range regs {
+		if r == 0 {
+			continue
+		}
+		low := uint64(i) & (1<<d - 1)
+		if low == 0 {
+			r += d
+		} else {
+			r = uint8(bits.LeadingZeros64(low<<(64-d)) + 1)
+		}
+		if j := i >> d; r > out[j] {
+			out[j] = r
+		}
+	}
+	return out
+}
+
+// Registers are written as index & value pairs when most
+// of them are empty, which is the case for most intervals.
+func (h *HLL) encode(buf *bytes.Buffer) {
+	buf.WriteByte(h.p)
+	if h.regs == nil {
+		buf.WriteByte(hllHashes)
+		writeUvarint(buf, uint64(len(h.hashes)))
+		for x := range h.hashes {
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], x)
+			buf.Write(b[:])
+		}
+		return
+	}
+	var n int
+	for _, r := range h.regs {
+		if r > 0 {
+			n++
+		}
+	}
+	if n > len(h.regs)/3 {
+		buf.WriteByte(hllDense)
+		buf.Write(h.regs)
+		return
+	}
+	buf.WriteByte(hllSparse)
+	writeUvarint(buf, uint64(n))
+	prev := 0
+	for i, r := range h.regs {
+		if r > 0 {
+			writeUvarint(buf, uint64(i-prev))
+			buf.WriteByte(r)
+			prev = i
+		}
+	}
+}
+
+func decodeHLL(buf *bytes.Reader) (*HLL, error) {
+	p, err := buf.ReadByte()
+	if err != nil || p < 4 || p > 18 {
+		return nil, ErrSketchEncoding
+	}
+	h := NewHLL(int(p))
+	mode, err := buf.ReadByte()
+	if err != nil {
+		return nil, ErrSketchEncoding
+	}
+	switch mode {
+	case hllHashes:
+		n, err := binary.ReadUvarint(buf)
+		if err != nil || n > uint64(buf.Len()/8) {
+			return nil, ErrSketchEncoding
+		}
+		var b [8]byte
+		for i := uint64(0); i < n; i++ {
+			if _, err := io.ReadFull(buf, b[:]); err != nil {
+				return nil, ErrSketchEncoding
+			}
+			h.hashes[binary.LittleEndian.Uint64(b[:])] = struct{}{}
+		}
+	case hllSparse:
+		h.toRegisters()
+		n, err := binary.ReadUvarint(buf)
+		if err != nil || n > uint64(len(h.regs)) {
+			return nil, ErrSketchEncoding
+		}
+		i := uint64(0)
+		for j := uint64(0); j < n; j++ {
+			d, err := binary.ReadUvarint(buf)
+			if err != nil {
+				return nil, ErrSketchEncoding
+			}
+			r, err := buf.ReadByte()
+			if i += d; err != nil || i >= uint64(len(h.regs)) {
+				return nil, ErrSketchEncoding
+			}
+			h.regs[i] = r
+		}
+	case hllDense:
+		h.toRegisters()
+		if _, err := io.ReadFull(buf, h.regs); err != nil {
+			return nil, ErrSketchEncoding
+		}
+	default:
+		return nil, ErrSketchEncoding
+	}
+	return h, nil
+}
+
+// FNV alone does not spread similar values (e.g. sequential
+// ids) well enough, so the hash is finished with murmur3's fmix64.
+func hash64(v []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(v)
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb3f99ec53a63
+	x ^= x >> 33
+	return x
+}
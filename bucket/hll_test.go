@@ -0,0 +1,86 @@
+package bucket
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func addRange(h *HLL, from, to int) {
+	for i := from; i < to; i++ {
+		h.Add([]byte(fmt.Sprintf("user-%d", i)))
+	}
+}
+
+// Allows 4 standard errors.
+func near(actual uint64, expected int, p uint8) bool {
+	e := 4 * 1.04 / math.Sqrt(float64(uint(1)<<p))
+	return math.Abs(float64(actual)-float64(expected)) <= e*float64(expected)
+}
+
+var hllTest = []struct {
+	n int
+	p int
+}{
+	{0, 14},
+	{10, 14},
+	{hllExact, 14},
+	{1000, 14},
+	{100000, 14},
+	{100000, 10},
+}
+
+func TestHLLCount(t *testing.T) {
+	for _, ts := range hllTest {
+		h := NewHLL(ts.p)
+		addRange(h, 0, ts.n)
+		// Duplicates are not counted.
+		addRange(h, 0, ts.n/2)
+		c := h.Count()
+		if ts.n <= hllExact && c != uint64(ts.n) {
+			t.Fatalf("n=%d actual=%d expected an exact count\n", ts.n, c)
+		}
+		if !near(c, ts.n, h.p) {
+			t.Fatalf("n=%d p=%d actual=%d\n", ts.n, ts.p, c)
+		}
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	a, b := NewHLL(14), NewHLL(12)
+	addRange(a, 0, 60000)
+	addRange(b, 40000, 100000)
+	small := NewHLL(14)
+	addRange(small, 99990, 100010)
+	a.Merge(small)
+	a.Merge(b)
+	if a.p != 12 {
+		t.Fatalf("Expected the merge to fold to the smaller precision. actual=%d\n", a.p)
+	}
+	if c := a.Count(); !near(c, 100010, 12) {
+		t.Fatalf("actual=%d expected=100010\n", c)
+	}
+}
+
+func TestEncodeUniques(t *testing.T) {
+	for _, n := range []int{3, 2000, 200000} {
+		b := &Bucket{Id: new(Id)}
+		for i := 0; i < n; i++ {
+			b.AddUnique([]byte(fmt.Sprintf("u%d", i)))
+		}
+		other := &Bucket{Id: new(Id)}
+		if err := other.MergeEncoded(b.EncodeVals()); err != nil {
+			t.Fatalf("n=%d error=%s\n", n, err)
+		}
+		if other.Uniques.Count() != b.Uniques.Count() {
+			t.Fatalf("n=%d actual=%d expected=%d\n",
+				n, other.Uniques.Count(), b.Uniques.Count())
+		}
+	}
+	b := &Bucket{Id: &Id{Name: "users", Type: "unique"}}
+	b.AddUnique([]byte("a"))
+	b.AddUnique([]byte("a"))
+	if m := b.Metrics(); len(m) != 1 || *m[0].Val != 1 {
+		t.Fatalf("actual=%v expected a gauge of 1\n", m)
+	}
+}
@@ -18,6 +18,43 @@ type Id struct {
 	Units      string
 	Source     string
 	Type       string
+	// The percentiles emitted for a measurement as given by
+	// FormatPercentiles. Empty means DefaultPercentiles.
+	Percentiles string
+	// How percentiles are computed. Empty means
+	// DefaultPercentileMethod.
+	PercentileMethod string
+	// Emit the mean of a measurement as its own series.
+	Mean bool
+	// Emit the per-second rate of a counter. See RateAlso.
+	Rate string
+	// The bounds of a histogram as given by FormatBounds.
+	// Empty means DefaultBounds.
+	Bounds string
+}
+
+// Invalid bounds fall back to DefaultBounds.
+func (id *Id) BoundList() []float64 {
+	if len(id.Bounds) == 0 {
+		return DefaultBounds
+	}
+	bs, err := ParseBounds(id.Bounds)
+	if err != nil {
+		return DefaultBounds
+	}
+	return bs
+}
+
+// Invalid percentiles fall back to DefaultPercentiles.
+func (id *Id) PercentileList() []float64 {
+	if len(id.Percentiles) == 0 {
+		return DefaultPercentiles
+	}
+	ps, err := ParsePercentiles(id.Percentiles)
+	if err != nil {
+		return DefaultPercentiles
+	}
+	return ps
 }
 
 func (id *Id) Partition(max uint64) uint64 {
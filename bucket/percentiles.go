@@ -0,0 +1,113 @@
+package bucket
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPercentiles      = errors.New("Percentiles must be a list of at most 16 numbers in (0, 100).")
+	ErrPercentileMethod = errors.New("Unknown percentile method.")
+)
+
+// Methods of computing a percentile from a bucket's values.
+// See https://en.wikipedia.org/wiki/Percentile
+const (
+	// The smallest value such that at least p percent of
+	// the values are less than or equal to it.
+	NearestRank = "nearest-rank"
+	// Interpolates between the two closest ranks where the
+	// rank of percentile p is p/100*(n-1). The method used by
+	// numpy and spreadsheets (PERCENTILE.INC) by default.
+	Linear = "linear"
+)
+
+// Used for buckets whose id does not name a method.
+const DefaultPercentileMethod = NearestRank
+
+// Returns ErrPercentileMethod for unknown methods.
+func CheckPercentileMethod(m string) error {
+	switch m {
+	case NearestRank, Linear:
+		return nil
+	}
+	return ErrPercentileMethod
+}
+
+// Emitted for measurements when a drain does not ask for percentiles.
+var DefaultPercentiles = []float64{50, 95, 99}
+
+const maxPercentiles = 16
+
+// Parses a comma separated list such as "50,75,99.9".
+// The percentiles are returned sorted and without duplicates.
+func ParsePercentiles(s string) ([]float64, error) {
+	var ps []float64
+	seen := make(map[float64]bool)
+	for _, f := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || !(p > 0 && p < 100) {
+			return nil, ErrPercentiles
+		}
+		if !seen[p] {
+			seen[p] = true
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) > maxPercentiles {
+		return nil, ErrPercentiles
+	}
+	sort.Float64s(ps)
+	return ps, nil
+}
+
+// The form of the percentiles that is kept on the bucket.Id.
+func FormatPercentiles(ps []float64) string {
+	s := make([]string, len(ps))
+	for i, p := range ps {
+		s[i] = strconv.FormatFloat(p, 'f', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+// Returns percentile p, in [0, 100], of the n sorted values
+// where valueAt(i) is the value with the zero based rank i.
+func percentile(method string, p float64, n int, valueAt func(int) float64) float64 {
+	if n == 0 {
+		return 0
+	}
+	switch method {
+	case Linear:
+		h := p * float64(n-1) / 100
+		i := math.Floor(h)
+		if int(i) >= n-1 {
+			return valueAt(n - 1)
+		}
+		lo, hi := valueAt(int(i)), valueAt(int(i)+1)
+		return lo + (h-i)*(hi-lo)
+	default:
+		// Multiplying before dividing keeps ranks such as
+		// 95*20/100 exact.
+		r := int(math.Ceil(p * float64(n) / 100))
+		if r < 1 {
+			r = 1
+		}
+		if r > n {
+			r = n
+		}
+		return valueAt(r - 1)
+	}
+}
+
+// The suffix of the metric that holds percentile p.
+// E.g. .median, .perc95 and .perc99_9
+func PercentileSuffix(p float64) string {
+	if p == 50 {
+		return ".median"
+	}
+	s := strconv.FormatFloat(p, 'f', -1, 64)
+	return ".perc" + strings.Replace(s, ".", "_", 1)
+}
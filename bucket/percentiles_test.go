@@ -0,0 +1,136 @@
+package bucket
+
+import (
+	"math"
+	"testing"
+)
+
+var percentilesTest = []struct {
+	in  string
+	out string
+	err error
+}{
+	{"50,75,99.9", "50,75,99.9", nil},
+	{"99, 50,99", "50,99", nil},
+	{"0.5", "0.5", nil},
+	{"100", "", ErrPercentiles},
+	{"0", "", ErrPercentiles},
+	{"-1", "", ErrPercentiles},
+	{"50,", "", ErrPercentiles},
+	{"NaN", "", ErrPercentiles},
+	{"1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17", "", ErrPercentiles},
+}
+
+func TestParsePercentiles(t *testing.T) {
+	for _, ts := range percentilesTest {
+		ps, err := ParsePercentiles(ts.in)
+		if err != ts.err || FormatPercentiles(ps) != ts.out {
+			t.Fatalf("in=%q actual=%q,%v expected=%q,%v\n",
+				ts.in, FormatPercentiles(ps), err, ts.out, ts.err)
+		}
+	}
+}
+
+var emitPercentilesTest = []struct {
+	percentiles string
+	names       []string
+}{
+	{"", []string{"x", "x.median", "x.perc95", "x.perc99", "x.stddev", "x.variance"}},
+	{"50,75,99.9", []string{"x", "x.median", "x.perc75", "x.perc99_9", "x.stddev", "x.variance"}},
+	{"bogus", []string{"x", "x.median", "x.perc95", "x.perc99", "x.stddev", "x.variance"}},
+}
+
+func TestEmitPercentiles(t *testing.T) {
+	for _, ts := range emitPercentilesTest {
+		id := &Id{Name: "x", Type: "measurement", Percentiles: ts.percentiles}
+		b := &Bucket{Id: id}
+		for i := 1; i <= 1000; i++ {
+			b.Append(float64(i))
+		}
+		metrics := b.Metrics()
+		if len(metrics) != len(ts.names) {
+			t.Fatalf("percentiles=%q actual-len=%d expected-len=%d\n",
+				ts.percentiles, len(metrics), len(ts.names))
+		}
+		for i, m := range metrics {
+			if m.Name != ts.names[i] {
+				t.Fatalf("actual=%s expected=%s\n", m.Name, ts.names[i])
+			}
+		}
+	}
+}
+
+// Reference values from https://en.wikipedia.org/wiki/Percentile
+// and numpy.percentile (linear is numpy's default method).
+var percentileMethodTest = []struct {
+	method string
+	vals   []float64
+	p      float64
+	out    float64
+}{
+	{NearestRank, []float64{15, 20, 35, 40, 50}, 5, 15},
+	{NearestRank, []float64{15, 20, 35, 40, 50}, 30, 20},
+	{NearestRank, []float64{15, 20, 35, 40, 50}, 40, 20},
+	{NearestRank, []float64{15, 20, 35, 40, 50}, 50, 35},
+	{NearestRank, []float64{15, 20, 35, 40, 50}, 100, 50},
+	{NearestRank, []float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 25, 7},
+	{NearestRank, []float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 50, 8},
+	{NearestRank, []float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 75, 15},
+	{NearestRank, []float64{3, 6, 7, 8, 8, 9, 10, 13, 15, 16, 20}, 25, 7},
+	{NearestRank, []float64{3, 6, 7, 8, 8, 9, 10, 13, 15, 16, 20}, 50, 9},
+	{NearestRank, []float64{3, 6, 7, 8, 8, 9, 10, 13, 15, 16, 20}, 75, 15},
+	{NearestRank, []float64{20, 12}, 50, 12},
+	{NearestRank, []float64{7}, 99, 7},
+	{Linear, []float64{15, 20, 35, 40, 50}, 5, 16},
+	{Linear, []float64{15, 20, 35, 40, 50}, 40, 29},
+	{Linear, []float64{15, 20, 35, 40, 50}, 50, 35},
+	{Linear, []float64{15, 20, 35, 40, 50}, 75, 40},
+	{Linear, []float64{15, 20, 35, 40, 50}, 90, 46},
+	{Linear, []float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 25, 7.25},
+	{Linear, []float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 50, 9},
+	{Linear, []float64{3, 6, 7, 8, 8, 10, 13, 15, 16, 20}, 75, 14.5},
+	{Linear, []float64{20, 12}, 50, 16},
+	{Linear, []float64{1, 2, 3, 4}, 99, 3.97},
+	{Linear, []float64{7}, 99, 7},
+	{"", []float64{20, 12}, 50, 12},
+}
+
+func TestPercentileMethods(t *testing.T) {
+	for _, ts := range percentileMethodTest {
+		id := &Id{PercentileMethod: ts.method}
+		b := &Bucket{Id: id, Vals: append([]float64(nil), ts.vals...)}
+		if actual := b.Percentile(ts.p); math.Abs(actual-ts.out) > 1e-9 {
+			t.Fatalf("method=%s vals=%v p=%f actual=%f expected=%f\n",
+				ts.method, ts.vals, ts.p, actual, ts.out)
+		}
+	}
+}
+
+// Large buckets are read from a sketch, which
+// should agree with the exact values within its accuracy.
+func TestPercentileMethodsSketch(t *testing.T) {
+	for _, method := range []string{NearestRank, Linear} {
+		exact := &Bucket{Id: &Id{PercentileMethod: method}}
+		b := &Bucket{Id: &Id{PercentileMethod: method}}
+		for i := 1; i <= 10*ExactValues; i++ {
+			v := float64(i * i)
+			exact.Vals = append(exact.Vals, v)
+			b.Append(v)
+		}
+		if b.Sketch == nil {
+			t.Fatalf("Expected the values to be folded into a sketch.")
+		}
+		for _, p := range []float64{1, 50, 90, 99, 99.9} {
+			e, a := exact.Percentile(p), b.Percentile(p)
+			if math.Abs(a-e) > Accuracy*e {
+				t.Fatalf("method=%s p=%f actual=%f expected=%f\n", method, p, a, e)
+			}
+		}
+	}
+}
+
+func TestCheckPercentileMethod(t *testing.T) {
+	if CheckPercentileMethod(Linear) != nil || CheckPercentileMethod("mean") != ErrPercentileMethod {
+		t.Fatalf("Expected only known methods to be accepted.")
+	}
+}
@@ -0,0 +1,33 @@
+package bucket
+
+import (
+	"errors"
+)
+
+var ErrRate = errors.New("Rate must be one of also or only.")
+
+// Counters emit the sum over the bucket's resolution. A drain can
+// ask for the per-second rate as well, or in place of the sum, so
+// that the scale of a counter does not depend on the resolution.
+const (
+	RateAlso = "also"
+	RateOnly = "only"
+)
+
+// The empty string, which emits only the sum, is valid.
+func CheckRate(r string) error {
+	switch r {
+	case "", RateAlso, RateOnly:
+		return nil
+	}
+	return ErrRate
+}
+
+// The sum of the values per second of the bucket's resolution.
+func (b *Bucket) Rate() float64 {
+	secs := b.Id.Resolution.Seconds()
+	if secs <= 0 {
+		return float64(0)
+	}
+	return b.Sum() / secs
+}
@@ -0,0 +1,53 @@
+package bucket
+
+import (
+	"testing"
+	"time"
+)
+
+var rateTest = []struct {
+	rate       string
+	resolution time.Duration
+	names      []string
+	vals       []float64
+}{
+	{"", time.Minute, []string{"c"}, []float64{120}},
+	{RateAlso, time.Minute, []string{"c", "c.rate"}, []float64{120, 2}},
+	{RateOnly, time.Minute, []string{"c.rate"}, []float64{2}},
+	{RateOnly, time.Second, []string{"c.rate"}, []float64{120}},
+	{RateOnly, 0, []string{"c.rate"}, []float64{0}},
+}
+
+func TestEmitRate(t *testing.T) {
+	for _, ts := range rateTest {
+		id := &Id{Name: "c", Type: "counter", Resolution: ts.resolution, Rate: ts.rate}
+		b := &Bucket{Id: id, Vals: []float64{100, 20}}
+		metrics := b.Metrics()
+		if len(metrics) != len(ts.names) {
+			t.Fatalf("rate=%q actual-len=%d expected-len=%d\n",
+				ts.rate, len(metrics), len(ts.names))
+		}
+		for i, m := range metrics {
+			if m.Name != ts.names[i] || *m.Val != ts.vals[i] {
+				t.Fatalf("rate=%q actual=%s,%f expected=%s,%f\n",
+					ts.rate, m.Name, *m.Val, ts.names[i], ts.vals[i])
+			}
+		}
+	}
+	id := &Id{Name: "c", Type: "counter", Resolution: time.Minute, Rate: RateAlso, Units: "requests"}
+	metrics := (&Bucket{Id: id, Vals: []float64{1}}).Metrics()
+	if u := metrics[0].Attr.Units; u != "requests" {
+		t.Fatalf("actual=%s expected=requests\n", u)
+	}
+	if u := metrics[1].Attr.Units; u != "requests/s" {
+		t.Fatalf("actual=%s expected=requests/s\n", u)
+	}
+	id.Units = ""
+	metrics = (&Bucket{Id: id, Vals: []float64{1}}).Metrics()
+	if u := metrics[1].Attr.Units; u != "count/s" {
+		t.Fatalf("actual=%s expected=count/s\n", u)
+	}
+	if CheckRate("sometimes") != ErrRate {
+		t.Fatalf("Expected unknown rates to be rejected.")
+	}
+}
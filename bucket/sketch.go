@@ -0,0 +1,320 @@
+package bucket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+var ErrSketchEncoding = errors.New("bucket: invalid sketch encoding")
+
+// The relative accuracy of new sketches. A quantile read from a
+// sketch is within Accuracy of the true value. E.g. 0.01 means
+// a perc99 of 200ms is reported as something in [198ms, 202ms].
+var Accuracy = 0.01
+
+// A mergeable quantile sketch (DDSketch). Values are counted in
+// bins whose bounds grow geometrically, so the size of the sketch
+// depends on the range of the values and not on their number.
+// Count, sum, min, max, variance and the last value are exact.
+type Sketch struct {
+	alpha   float64
+	lnGamma float64
+	// Bins for positive values and for the magnitude of negatives.
+	pos   map[int]uint64
+	neg   map[int]uint64
+	zeros uint64
+	count uint64
+	sum   float64
+	// The sum of squared differences from the mean. Kept
+	// rather than the sum of squares as it is numerically stable.
+	m2   float64
+	min  float64
+	max  float64
+	last float64
+}
+
+// Uses Accuracy if alpha is not in (0, 1).
+func NewSketch(alpha float64) *Sketch {
+	if alpha <= 0 || alpha >= 1 {
+		alpha = Accuracy
+	}
+	return &Sketch{
+		alpha:   alpha,
+		lnGamma: math.Log((1 + alpha) / (1 - alpha)),
+		pos:     make(map[int]uint64),
+		neg:     make(map[int]uint64),
+	}
+}
+
+func (s *Sketch) Alpha() float64 { return s.alpha }
+func (s *Sketch) Count() int     { return int(s.count) }
+func (s *Sketch) Sum() float64   { return s.sum }
+func (s *Sketch) Min() float64   { return s.min }
+func (s *Sketch) Max() float64   { return s.max }
+func (s *Sketch) Last() float64  { return s.last }
+
+// The population variance.
+func (s *Sketch) Variance() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.m2 / float64(s.count)
+}
+
+func (s *Sketch) mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.count)
+}
+
+// Combines the m2 of two sets of values as described by
+// Chan et al. Must be called before the count and sum of
+// the first set are updated.
+func (s *Sketch) mergeM2(n uint64, sum, m2 float64) {
+	if s.count == 0 {
+		s.m2 = m2
+		return
+	}
+	d := sum/float64(n) - s.mean()
+	na, nb := float64(s.count), float64(n)
+	s.m2 += m2 + d*d*na*nb/(na+nb)
+}
+
+// The number of bins in use. A measure of the sketch's memory.
+func (s *Sketch) Size() int {
+	return len(s.pos) + len(s.neg)
+}
+
+func (s *Sketch) Add(v float64) {
+	s.addN(v, 1)
+	s.last = v
+}
+
+func (s *Sketch) addN(v float64, n uint64) {
+	if n == 0 {
+		return
+	}
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.mergeM2(n, v*float64(n), 0)
+	s.count += n
+	s.sum += v * float64(n)
+	switch {
+	case v > 0:
+		s.pos[s.key(v)] += n
+	case v < 0:
+		s.neg[s.key(-v)] += n
+	default:
+		s.zeros += n
+	}
+}
+
+func (s *Sketch) key(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.lnGamma))
+}
+
+// The value that represents all of the values in a bin.
+func (s *Sketch) value(k int) float64 {
+	return 2 * math.Exp(float64(k)*s.lnGamma) / (1 + math.Exp(s.lnGamma))
+}
+
+// Adds the values of other to s. If the sketches were built with
+// different accuracies, the values of other are re-binned into s,
+// so the error of the two sketches adds up for those values.
+func (s *Sketch) Merge(other *Sketch) {
+	if other.count == 0 {
+		return
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	m2 := s.m2
+	s.mergeM2(other.count, other.sum, other.m2)
+	m2, s.m2 = s.m2, m2
+	if other.alpha == s.alpha {
+		for k, n := range other.pos {
+			s.pos[k] += n
+		}
+		for k, n := range other.neg {
+			s.neg[k] += n
+		}
+		s.zeros += other.zeros
+		s.count += other.count
+		s.sum += other.sum
+	} else {
+		min, max, sum := s.min, s.max, s.sum+other.sum
+		for k, n := range other.pos {
+			s.addN(other.value(k), n)
+		}
+		for k, n := range other.neg {
+			s.addN(-other.value(k), n)
+		}
+		s.addN(0, other.zeros)
+		s.min, s.max, s.sum = min, max, sum
+	}
+	s.m2 = m2
+	s.last = other.last
+}
+
+// Returns the value at rank q*(count-1), where q is in [0, 1].
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.ValueAt(int(math.Max(0, q) * float64(s.count-1)))
+}
+
+// Returns the value with the given zero based rank, as if the
+// values had been sorted. Ranks outside [0, count) are clamped.
+func (s *Sketch) ValueAt(i int) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if i <= 0 {
+		return s.min
+	}
+	if uint64(i) >= s.count-1 {
+		return s.max
+	}
+	rank := uint64(i)
+	var seen uint64
+	var v float64
+	found := false
+	// Negative values are visited from the largest magnitude down.
+	for _, k := range sortedKeys(s.neg, true) {
+		seen += s.neg[k]
+		if seen > rank {
+			v, found = -s.value(k), true
+			break
+		}
+	}
+	if !found {
+		seen += s.zeros
+		if seen > rank {
+			v, found = 0, true
+		}
+	}
+	if !found {
+		for _, k := range sortedKeys(s.pos, false) {
+			seen += s.pos[k]
+			if seen > rank {
+				v = s.value(k)
+				break
+			}
+		}
+	}
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+func sortedKeys(m map[int]uint64, desc bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if desc {
+		sort.Sort(sort.Reverse(sort.IntSlice(keys)))
+	} else {
+		sort.Ints(keys)
+	}
+	return keys
+}
+
+// A compact binary encoding. Bins are written in key order
+// with the keys delta encoded as varints.
+func (s *Sketch) encode(buf *bytes.Buffer) {
+	writeFloat(buf, s.alpha)
+	writeUvarint(buf, s.count)
+	writeFloat(buf, s.sum)
+	writeFloat(buf, s.m2)
+	writeFloat(buf, s.min)
+	writeFloat(buf, s.max)
+	writeFloat(buf, s.last)
+	writeUvarint(buf, s.zeros)
+	for _, m := range []map[int]uint64{s.pos, s.neg} {
+		writeUvarint(buf, uint64(len(m)))
+		prev := 0
+		for _, k := range sortedKeys(m, false) {
+			writeVarint(buf, int64(k-prev))
+			writeUvarint(buf, m[k])
+			prev = k
+		}
+	}
+}
+
+func decodeSketch(buf *bytes.Reader) (*Sketch, error) {
+	alpha, err := readFloat(buf)
+	if err != nil {
+		return nil, err
+	}
+	if alpha <= 0 || alpha >= 1 {
+		return nil, ErrSketchEncoding
+	}
+	s := NewSketch(alpha)
+	if s.count, err = binary.ReadUvarint(buf); err != nil {
+		return nil, ErrSketchEncoding
+	}
+	for _, f := range []*float64{&s.sum, &s.m2, &s.min, &s.max, &s.last} {
+		if *f, err = readFloat(buf); err != nil {
+			return nil, err
+		}
+	}
+	if s.zeros, err = binary.ReadUvarint(buf); err != nil {
+		return nil, ErrSketchEncoding
+	}
+	for _, m := range []map[int]uint64{s.pos, s.neg} {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil || n > uint64(buf.Len()) {
+			return nil, ErrSketchEncoding
+		}
+		prev := 0
+		for i := uint64(0); i < n; i++ {
+			d, err := binary.ReadVarint(buf)
+			if err != nil {
+				return nil, ErrSketchEncoding
+			}
+			c, err := binary.ReadUvarint(buf)
+			if err != nil {
+				return nil, ErrSketchEncoding
+			}
+			prev += int(d)
+			m[prev] += c
+		}
+	}
+	return s, nil
+}
+
+func writeFloat(buf *bytes.Buffer, f float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	buf.Write(b[:])
+}
+
+func readFloat(buf *bytes.Reader) (float64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(buf, b[:]); err != nil {
+		return 0, ErrSketchEncoding
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+func writeVarint(buf *bytes.Buffer, x int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], x)])
+}
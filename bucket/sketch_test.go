@@ -0,0 +1,140 @@
+package bucket
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+var quantileTest = []float64{0.01, 0.25, 0.5, 0.75, 0.95, 0.99}
+
+func within(actual, expected, alpha float64) bool {
+	return math.Abs(actual-expected) <= alpha*math.Abs(expected)+1e-9
+}
+
+func TestSketchAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	s := NewSketch(0.01)
+	vals := make([]float64, 10000)
+	for i := range vals {
+		vals[i] = rng.ExpFloat64() * 100
+		s.Add(vals[i])
+	}
+	sort.Float64s(vals)
+	for _, q := range quantileTest {
+		expected := vals[int(q*float64(len(vals)-1))]
+		if actual := s.Quantile(q); !within(actual, expected, 0.01) {
+			t.Fatalf("q=%f actual=%f expected=%f\n", q, actual, expected)
+		}
+	}
+	if s.Min() != vals[0] || s.Max() != vals[len(vals)-1] {
+		t.Fatalf("actual-min=%f actual-max=%f\n", s.Min(), s.Max())
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	all, a, b := NewSketch(0.01), NewSketch(0.01), NewSketch(0.02)
+	for i := 1; i <= 1000; i++ {
+		v := float64(i - 100)
+		all.Add(v)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	a.Merge(b)
+	if a.Count() != all.Count() || a.Sum() != all.Sum() || a.Last() != b.Last() {
+		t.Fatalf("actual=%d,%f,%f expected=%d,%f,%f\n",
+			a.Count(), a.Sum(), a.Last(), all.Count(), all.Sum(), b.Last())
+	}
+	for _, q := range quantileTest {
+		// The values of b were binned twice.
+		if !within(a.Quantile(q), all.Quantile(q), 0.03) {
+			t.Fatalf("q=%f actual=%f expected=%f\n", q, a.Quantile(q), all.Quantile(q))
+		}
+	}
+}
+
+func TestBucketFold(t *testing.T) {
+	b := &Bucket{Id: &Id{Type: "sample"}}
+	for i := 1; i <= ExactValues+10; i++ {
+		b.Append(float64(i))
+	}
+	if b.Sketch == nil || len(b.Vals) >= ExactValues {
+		t.Fatalf("Expected values to be folded into a sketch. vals=%d\n", len(b.Vals))
+	}
+	n := ExactValues + 10
+	if b.Count() != n || b.Sum() != float64(n*(n+1)/2) || b.Last() != float64(n) {
+		t.Fatalf("actual=%d,%f,%f\n", b.Count(), b.Sum(), b.Last())
+	}
+	if b.Min() != 1 || b.Max() != float64(n) {
+		t.Fatalf("actual-min=%f actual-max=%f\n", b.Min(), b.Max())
+	}
+}
+
+func TestEncodeVals(t *testing.T) {
+	b := &Bucket{Id: new(Id)}
+	for i := 0; i < ExactValues*3; i++ {
+		b.Append(float64(i % 50))
+	}
+	b.Append(-1.5)
+	b.Append(7.25)
+	other := &Bucket{Id: new(Id), Vals: []float64{1000}}
+	if err := other.MergeEncoded(b.EncodeVals()); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if other.Count() != b.Count()+1 || other.Sum() != b.Sum()+1000 {
+		t.Fatalf("actual=%d,%f expected=%d,%f\n",
+			other.Count(), other.Sum(), b.Count()+1, b.Sum()+1000)
+	}
+	if other.Min() != -1.5 || other.Max() != 1000 || other.Last() != 7.25 {
+		t.Fatalf("actual=%f,%f,%f\n", other.Min(), other.Max(), other.Last())
+	}
+	if other.Median() != b.Median() {
+		t.Fatalf("actual=%f expected=%f\n", other.Median(), b.Median())
+	}
+	for _, p := range [][]byte{nil, {valsEncoding, 200}, {'1', '.', '5'}} {
+		if err := other.MergeEncoded(p); err != ErrSketchEncoding {
+			t.Fatalf("input=%v actual-err=%v\n", p, err)
+		}
+	}
+}
+
+func TestVariance(t *testing.T) {
+	// The population variance of 2,4,4,4,5,5,7,9 is 4.
+	exact := &Bucket{Id: &Id{Type: "measurement", Mean: true}, Vals: []float64{2, 4, 4, 4, 5, 5, 7, 9}}
+	if exact.Variance() != 4 || exact.StdDev() != 2 {
+		t.Fatalf("actual=%f,%f expected=4,2\n", exact.Variance(), exact.StdDev())
+	}
+	metrics := exact.Metrics()
+	if m := metrics[len(metrics)-1]; m.Name != ".mean" || *m.Val != 5 {
+		t.Fatalf("actual=%s,%f expected=.mean,5\n", m.Name, *m.Val)
+	}
+
+	// Sketches built by separate receivers with
+	// different accuracies merge to the same variance.
+	rng := rand.New(rand.NewSource(1))
+	all := &Bucket{Id: new(Id)}
+	a := &Bucket{Id: new(Id), Sketch: NewSketch(0.01)}
+	b := &Bucket{Id: new(Id), Sketch: NewSketch(0.05)}
+	for i := 0; i < 10000; i++ {
+		v := 1e6 + rng.NormFloat64()*10
+		all.Vals = append(all.Vals, v)
+		if i%3 == 0 {
+			a.Append(v)
+		} else {
+			b.Append(v)
+		}
+	}
+	merged := &Bucket{Id: new(Id)}
+	for _, x := range []*Bucket{a, b} {
+		if err := merged.MergeEncoded(x.EncodeVals()); err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+	}
+	if math.Abs(merged.Variance()-all.Variance()) > 1e-6*all.Variance() {
+		t.Fatalf("actual=%f expected=%f\n", merged.Variance(), all.Variance())
+	}
+}
@@ -0,0 +1,135 @@
+// The clock pkg abstracts the passing of time so that the
+// pipeline can run on a simulated clock. Components that
+// aggregate by time or work on an interval take their clock
+// from conf.D. Latency measurements sent to metchan always
+// use the real clock.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Delivers the time on C at intervals. Like time.Ticker,
+// ticks are dropped when the receiver falls behind.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// The wall clock.
+var Real Clock = wall{}
+
+// Returns Real when c is nil. Constructors use this so that
+// a conf.D built without a clock runs on the wall clock.
+func Default(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+type wall struct{}
+
+func (wall) Now() time.Time {
+	return time.Now()
+}
+
+func (wall) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+// A clock that only moves when it is told to. Moving the clock
+// fires the tickers whose interval has elapsed in the order
+// that they would have fired on the wall clock.
+type Sim struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*simTicker
+}
+
+type simTicker struct {
+	c    chan time.Time
+	d    time.Duration
+	next time.Time
+}
+
+func NewSim(t time.Time) *Sim {
+	return &Sim{now: t}
+}
+
+func (s *Sim) Now() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.now
+}
+
+func (s *Sim) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	s.Lock()
+	defer s.Unlock()
+	st := &simTicker{c: make(chan time.Time, 1), d: d, next: s.now.Add(d)}
+	s.tickers = append(s.tickers, st)
+	return &Ticker{C: st.c, stop: func() { s.remove(st) }}
+}
+
+// Moves the clock forward by d.
+func (s *Sim) Add(d time.Duration) {
+	s.Set(s.Now().Add(d))
+}
+
+// Moves the clock to t. The clock never moves backwards.
+func (s *Sim) Set(t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for {
+		st := s.due(t)
+		if st == nil {
+			break
+		}
+		s.now = st.next
+		st.next = st.next.Add(st.d)
+		select {
+		case st.c <- s.now:
+		default:
+		}
+	}
+	if t.After(s.now) {
+		s.now = t
+	}
+}
+
+// Returns the ticker that fires first at or before t.
+func (s *Sim) due(t time.Time) *simTicker {
+	sort.SliceStable(s.tickers, func(i, j int) bool {
+		return s.tickers[i].next.Before(s.tickers[j].next)
+	})
+	if len(s.tickers) > 0 && !s.tickers[0].next.After(t) {
+		return s.tickers[0]
+	}
+	return nil
+}
+
+func (s *Sim) remove(st *simTicker) {
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.tickers {
+		if s.tickers[i] == st {
+			s.tickers = append(s.tickers[:i], s.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimTickers(t *testing.T) {
+	start := time.Date(2013, 5, 7, 12, 0, 0, 0, time.UTC)
+	s := NewSim(start)
+	fast := s.NewTicker(time.Second)
+	slow := s.NewTicker(time.Minute)
+	s.Add(1500 * time.Millisecond)
+	select {
+	case tick := <-fast.C:
+		if !tick.Equal(start.Add(time.Second)) {
+			t.Fatalf("actual=%s expected=%s\n", tick, start.Add(time.Second))
+		}
+	default:
+		t.Fatalf("Expected fast ticker to fire.")
+	}
+	select {
+	case <-slow.C:
+		t.Fatalf("Expected slow ticker to wait.")
+	default:
+	}
+	s.Add(time.Minute)
+	select {
+	case tick := <-slow.C:
+		if !tick.Equal(start.Add(time.Minute)) {
+			t.Fatalf("actual=%s expected=%s\n", tick, start.Add(time.Minute))
+		}
+	default:
+		t.Fatalf("Expected slow ticker to fire.")
+	}
+	if !s.Now().Equal(start.Add(61500 * time.Millisecond)) {
+		t.Fatalf("actual=%s\n", s.Now())
+	}
+	fast.Stop()
+	s.Add(time.Second)
+	// The buffered tick from before Stop is the only one left.
+	<-fast.C
+	select {
+	case <-fast.C:
+		t.Fatalf("Expected stopped ticker to stay quiet.")
+	default:
+	}
+}
@@ -5,6 +5,8 @@ package conf
 import (
 	"errors"
 	"flag"
+	"github.com/ryandotsmith/l2met/clock"
+	"io"
 	"net/url"
 	"os"
 	"strings"
@@ -22,6 +24,18 @@ type D struct {
 	Concurrency      int
 	Port             int
 	ReceiverDeadline int64
+	LatePolicy       string
+	MaxBodySize      int64
+	TenantInFlight   int
+	DedupHeader      string
+	DedupWindow      time.Duration
+	SyncAck          bool
+	RegisterSeries   int
+	RegisterVals     int
+	SketchAccuracy   float64
+	SketchValues     int
+	ShutdownTimeout  time.Duration
+	ClockInterval    time.Duration
 	OutletRetries    int
 	OutletTtl        time.Duration
 	MaxPartitions    uint64
@@ -30,6 +44,19 @@ type D struct {
 	UsingReciever    bool
 	UseOutlet        bool
 	Verbose          bool
+	UsingStatsd      bool
+	StatsdAddr       string
+	StatsdAuth       string
+	StatsdResolution time.Duration
+	StatsdSourceTags []string
+	UsingPrometheus  bool
+	PromSourceLabels []string
+	// Components that aggregate by time or work on an interval
+	// use this clock. Replays and tests use a simulated clock.
+	Clock clock.Clock
+	// Diagnostics are written here. Defaults to stdout.
+	// Replays print their report to stdout, so they use stderr.
+	Log io.Writer
 }
 
 // Builds a conf data structure and connects
@@ -37,6 +64,7 @@ type D struct {
 // It is up to the caller to call flag.Parse()
 func New() *D {
 	d := new(D)
+	d.Clock = clock.Real
 
 	flag.BoolVar(&d.PrintVersion, "version", false,
 		"Print l2met version and sha.")
@@ -59,6 +87,45 @@ func New() *D {
 	flag.Int64Var(&d.ReceiverDeadline, "recv-deadline", 2,
 		"Number of time units to pass before dropping incoming logs.")
 
+	flag.StringVar(&d.LatePolicy, "late-policy", "drop",
+		"What to do with data that is past the receiver deadline: "+
+			"drop, retime or accept. Drains can override with ?late=")
+
+	flag.Int64Var(&d.MaxBodySize, "max-body-size", 8<<20,
+		"Max bytes in a request body after decompression. "+
+			"Larger requests are rejected with a 413.")
+
+	flag.IntVar(&d.TenantInFlight, "tenant-max-inflight", 0,
+		"Max concurrent requests per tenant before responding with a 429. "+
+			"0 disables the limit.")
+
+	flag.StringVar(&d.DedupHeader, "dedup-header", "",
+		"Header used to drop retried requests in addition to Logplex-Frame-Id.")
+
+	flag.DurationVar(&d.DedupWindow, "dedup-window", time.Minute*5,
+		"Time to remember request ids for deduplication. 0 disables.")
+
+	flag.BoolVar(&d.SyncAck, "sync-ack", false,
+		"Respond to receiver requests after buckets are written to the store. "+
+			"Drains can opt-in individually with ?sync-ack=true")
+
+	flag.IntVar(&d.RegisterSeries, "register-max-series", 0,
+		"Max buckets held in the receiver's register before spilling "+
+			"the largest buckets to the store. 0 disables the limit.")
+
+	flag.IntVar(&d.RegisterVals, "register-max-values", 0,
+		"Max values held in the receiver's register before spilling "+
+			"the largest buckets to the store. Sketches, uniques and histograms "+
+			"count their memory in values of 8 bytes. 0 disables the limit.")
+
+	flag.Float64Var(&d.SketchAccuracy, "sketch-accuracy", 0.01,
+		"Relative accuracy of the percentiles of large buckets. "+
+			"E.g. 0.01 reports a perc99 of 200ms as 198ms to 202ms.")
+
+	flag.IntVar(&d.SketchValues, "sketch-exact-values", 128,
+		"Number of raw values a bucket keeps before folding its values "+
+			"into a sketch. Smaller buckets report exact percentiles.")
+
 	flag.DurationVar(&d.OutletTtl, "outlet-ttl", time.Second*2,
 		"Timeout set on Librato HTTP requests.")
 
@@ -73,6 +140,13 @@ func New() *D {
 		"Time to wait before outlets read buckets from the store. "+
 			"Example:60s 30s 1m")
 
+	flag.DurationVar(&d.ShutdownTimeout, "shutdown-timeout", time.Second*25,
+		"Time allowed to drain the pipeline after SIGTERM before exiting.")
+
+	flag.DurationVar(&d.ClockInterval, "store-clock-interval", time.Second*10,
+		"Time between reads of the store's clock. Receivers and readers "+
+			"estimate the store's time from the local clock in between.")
+
 	flag.BoolVar(&d.UseOutlet, "outlet", false,
 		"Start the Librato outlet.")
 
@@ -82,8 +156,33 @@ func New() *D {
 	flag.BoolVar(&d.Verbose, "v", false,
 		"Enable verbose log output.")
 
+	flag.BoolVar(&d.UsingStatsd, "statsd", false,
+		"Enable the StatsD listener. Requires the receiver.")
+
+	flag.StringVar(&d.StatsdAddr, "statsd-addr", ":8125",
+		"UDP & TCP bind address for the StatsD listener.")
+
+	flag.DurationVar(&d.StatsdResolution, "statsd-resolution", time.Minute,
+		"Resolution of buckets built from StatsD lines. "+
+			"Example:60s 1s")
+
+	d.StatsdSourceTags = []string{"source"}
+	flag.Var((*listFlag)(&d.StatsdSourceTags), "statsd-source-tags",
+		"Comma separated DogStatsD tags used to build the source.")
+
+	flag.BoolVar(&d.UsingPrometheus, "prometheus", false,
+		"Accept Prometheus remote_write requests. Requires the receiver.")
+
+	d.PromSourceLabels = []string{"instance"}
+	flag.Var((*listFlag)(&d.PromSourceLabels), "prom-source-labels",
+		"Comma separated Prometheus labels used to build the source.")
+
 	d.RedisHost, d.RedisPass, _ = parseRedisUrl(env("REDIS_URL"))
-	d.Secrets = strings.Split(mustenv("SECRETS"), ":")
+	// Required by all commands except pipe. See main.
+	if s := env("SECRETS"); len(s) > 0 {
+		d.Secrets = strings.Split(s, ":")
+	}
+	d.StatsdAuth = env("STATSD_AUTH")
 
 	if len(env("METCHAN_URL")) > 0 {
 		url, err := url.Parse(env("METCHAN_URL"))
@@ -95,19 +194,23 @@ func New() *D {
 	return d
 }
 
+// Allows a comma separated flag value to be read into a slice.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = strings.Split(s, ",")
+	return nil
+}
+
 // Helper Function
 func env(n string) string {
 	return os.Getenv(n)
 }
 
-func mustenv(n string) string {
-	v := env(n)
-	if len(v) == 0 {
-		panic("Must set: " + n)
-	}
-	return v
-}
-
 // Helper Function
 func parseRedisUrl(s string) (string, string, error) {
 	u, err := url.Parse(s)
@@ -0,0 +1,181 @@
+// The emit pkg writes log lines that follow the l2met conventions.
+//
+//	e := emit.New(os.Stdout)
+//	e.Source = "web.1"
+//	e.Measure("db.latency", 12.5, "ms")
+//	// measure#db.latency=12.5ms source=web.1
+//
+// Lines are written with a single call to Write, so an Emitter can
+// be shared by goroutines when the underlying writer can be.
+package emit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrName  = errors.New("emit: names must not be empty or contain spaces, = or \"")
+	ErrUnits = errors.New("emit: units must be letters or symbols without spaces, = or \"")
+	// The l2met parser does not read signs or exponents.
+	ErrValue = errors.New("emit: values must be finite and not negative")
+)
+
+// The prefixes the l2met parser uses to pick a bucket type.
+const (
+	Measurement = "measure#"
+	Counter     = "count#"
+	Sample      = "sample#"
+	Total       = "total#"
+	Unique      = "unique#"
+	Histogram   = "histogram#"
+)
+
+// A single key=value pair. E.g. Metric{Measurement, "db", 12, "ms"}
+type Metric struct {
+	Type  string
+	Name  string
+	Val   float64
+	Units string
+}
+
+type Emitter struct {
+	w io.Writer
+	// Prepended to every name. E.g. a Prefix of api turns
+	// db.latency into api.db.latency
+	Prefix string
+	// Added to every line as source=Source when not empty.
+	Source string
+}
+
+func New(w io.Writer) *Emitter {
+	return &Emitter{w: w}
+}
+
+// Writes measure#name=val<units>
+func (e *Emitter) Measure(name string, val float64, units string) error {
+	return e.Emit(Metric{Measurement, name, val, units})
+}
+
+// Writes count#name=val. Counters are summed over the interval.
+func (e *Emitter) Count(name string, val float64) error {
+	return e.Emit(Metric{Counter, name, val, ""})
+}
+
+// Writes sample#name=val<units>. The last sample in the interval is kept.
+func (e *Emitter) Sample(name string, val float64, units string) error {
+	return e.Emit(Metric{Sample, name, val, units})
+}
+
+// Writes total#name=val. Use for running totals such as the
+// number of requests served since the process started. l2met
+// counts the increase between consecutive totals.
+func (e *Emitter) Total(name string, val float64) error {
+	return e.Emit(Metric{Total, name, val, ""})
+}
+
+// Writes histogram#name=val<units>. l2met counts the values
+// into the drain's bounds, e.g. to find the share of requests
+// served within 300ms.
+func (e *Emitter) Histogram(name string, val float64, units string) error {
+	return e.Emit(Metric{Histogram, name, val, units})
+}
+
+// Writes unique#name=value. l2met counts the distinct values
+// in each interval, e.g. the number of active users.
+func (e *Emitter) Unique(name, value string) error {
+	if len(e.Prefix) > 0 {
+		name = e.Prefix + "." + name
+	}
+	if !validName(name) || !validName(value) {
+		return ErrName
+	}
+	line := Unique + name + "=" + value
+	if len(e.Source) > 0 {
+		if !validName(e.Source) {
+			return ErrName
+		}
+		line += " source=" + e.Source
+	}
+	_, err := io.WriteString(e.w, line+"\n")
+	return err
+}
+
+// Measures the milliseconds elapsed since start.
+//
+//	defer e.Time("db.query", time.Now())
+func (e *Emitter) Time(name string, start time.Time) error {
+	ms := float64(time.Since(start)) / float64(time.Millisecond)
+	return e.Measure(name, ms, "ms")
+}
+
+// Writes the metrics on a single line. Nothing is written
+// if any of the metrics are invalid.
+func (e *Emitter) Emit(metrics ...Metric) error {
+	var buf bytes.Buffer
+	for i, m := range metrics {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		if err := e.write(&buf, m); err != nil {
+			return err
+		}
+	}
+	if len(e.Source) > 0 {
+		if !validName(e.Source) {
+			return ErrName
+		}
+		buf.WriteString(" source=" + e.Source)
+	}
+	buf.WriteByte('\n')
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *Emitter) write(buf *bytes.Buffer, m Metric) error {
+	switch m.Type {
+	case Measurement, Counter, Sample, Total, Histogram:
+	default:
+		return fmt.Errorf("emit: unknown type %q", m.Type)
+	}
+	name := m.Name
+	if len(e.Prefix) > 0 {
+		name = e.Prefix + "." + name
+	}
+	if !validName(name) {
+		return ErrName
+	}
+	if math.IsNaN(m.Val) || math.IsInf(m.Val, 0) || m.Val < 0 {
+		return ErrValue
+	}
+	if !validUnits(m.Units) {
+		return ErrUnits
+	}
+	buf.WriteString(m.Type + name + "=")
+	buf.WriteString(strconv.FormatFloat(m.Val, 'f', -1, 64))
+	buf.WriteString(m.Units)
+	return nil
+}
+
+func validName(s string) bool {
+	return len(s) > 0 && !strings.ContainsAny(s, " \t\r\n=\"")
+}
+
+// The parser reads the units as what remains after trimming
+// digits and dots from both ends of the value.
+func validUnits(s string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	if strings.ContainsAny(s, " \t\r\n=\"") {
+		return false
+	}
+	isNum := func(b byte) bool { return b == '.' || (b >= '0' && b <= '9') }
+	return !isNum(s[0]) && !isNum(s[len(s)-1])
+}
@@ -0,0 +1,164 @@
+package emit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+var emitTest = []struct {
+	desc   string
+	emit   func(e *Emitter) error
+	line   string
+	name   string
+	typ    string
+	val    float64
+	units  string
+	source string
+}{
+	{
+		"measure",
+		func(e *Emitter) error { return e.Measure("db.latency", 12.5, "ms") },
+		"measure#db.latency=12.5ms\n",
+		"db.latency", "measurement", 12.5, "ms", "",
+	},
+	{
+		"count",
+		func(e *Emitter) error { return e.Count("hits", 3) },
+		"count#hits=3\n",
+		"hits", "counter", 3, "", "",
+	},
+	{
+		"sample with units",
+		func(e *Emitter) error { return e.Sample("mem", 512, "MB") },
+		"sample#mem=512MB\n",
+		"mem", "sample", 512, "MB", "",
+	},
+	{
+		"total",
+		func(e *Emitter) error { return e.Total("requests", 182733) },
+		"total#requests=182733\n",
+		"requests", "total", 182733, "", "",
+	},
+	{
+		"prefix and source",
+		func(e *Emitter) error {
+			e.Prefix, e.Source = "api", "web.1"
+			return e.Count("hits", 1)
+		},
+		"count#api.hits=1 source=web.1\n",
+		"api.hits", "counter", 1, "", "web.1",
+	},
+	{
+		"large value",
+		func(e *Emitter) error { return e.Measure("bytes", 12345678912, "") },
+		"measure#bytes=12345678912\n",
+		"bytes", "measurement", 12345678912, "", "",
+	},
+	{
+		"small value",
+		func(e *Emitter) error { return e.Measure("ratio", 0.0001, "") },
+		"measure#ratio=0.0001\n",
+		"ratio", "measurement", 0.0001, "", "",
+	},
+}
+
+// Frames the line as logplex would.
+func frame(line string) string {
+	ts := time.Now().UTC().Format("2006-01-02T15:04:05+00:00")
+	packet := fmt.Sprintf("<190>1 %s hostname app web - %s", ts, strings.TrimSpace(line))
+	return fmt.Sprintf("%d %s", len(packet), packet)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range emitTest {
+		var buf bytes.Buffer
+		if err := tt.emit(New(&buf)); err != nil {
+			t.Fatalf("case=%s error=%s\n", tt.desc, err)
+		}
+		if buf.String() != tt.line {
+			t.Fatalf("case=%s actual=%q expected=%q\n", tt.desc, buf.String(), tt.line)
+		}
+		body := bufio.NewReader(strings.NewReader(frame(buf.String())))
+		opts := map[string][]string{"auth": []string{"abc123"}}
+		var n int
+		for b := range parser.BuildBuckets(body, opts, new(metchan.Channel), time.Now) {
+			n++
+			if b.Id.Name != tt.name || b.Id.Type != tt.typ ||
+				b.Id.Units != tt.units || b.Id.Source != tt.source {
+				t.Fatalf("case=%s actual=%+v\n", tt.desc, b.Id)
+			}
+			if len(b.Vals) != 1 || b.Vals[0] != tt.val {
+				t.Fatalf("case=%s actual=%v expected=%f\n", tt.desc, b.Vals, tt.val)
+			}
+		}
+		if n != 1 {
+			t.Fatalf("case=%s actual-buckets=%d expected-buckets=1\n", tt.desc, n)
+		}
+	}
+}
+
+func TestEmitMany(t *testing.T) {
+	var buf bytes.Buffer
+	e := New(&buf)
+	err := e.Emit(Metric{Measurement, "a", 1, "ms"}, Metric{Counter, "b", 2, ""},
+		Metric{Histogram, "c", 3, "ms"})
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if buf.String() != "measure#a=1ms count#b=2 histogram#c=3ms\n" {
+		t.Fatalf("actual=%q\n", buf.String())
+	}
+}
+
+var invalidTest = []struct {
+	m   Metric
+	err error
+}{
+	{Metric{Measurement, "a b", 1, ""}, ErrName},
+	{Metric{Measurement, "", 1, ""}, ErrName},
+	{Metric{Measurement, "a", -1, ""}, ErrValue},
+	{Metric{Sample, "a", 1, "2x"}, ErrUnits},
+	{Metric{Sample, "a", 1, "m s"}, ErrUnits},
+}
+
+func TestInvalid(t *testing.T) {
+	for _, tt := range invalidTest {
+		var buf bytes.Buffer
+		err := New(&buf).Emit(Metric{Counter, "ok", 1, ""}, tt.m)
+		if err != tt.err {
+			t.Fatalf("metric=%+v actual-err=%v expected-err=%v\n", tt.m, err, tt.err)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("Expected nothing to be written. actual=%q\n", buf.String())
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf).Time("q", time.Now().Add(-time.Second))
+	if !strings.HasPrefix(buf.String(), "measure#q=1") || !strings.HasSuffix(buf.String(), "ms\n") {
+		t.Fatalf("actual=%q\n", buf.String())
+	}
+}
+
+func TestUnique(t *testing.T) {
+	var buf bytes.Buffer
+	e := New(&buf)
+	e.Source = "web.1"
+	if err := e.Unique("users", "u-1234"); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if buf.String() != "unique#users=u-1234 source=web.1\n" {
+		t.Fatalf("actual=%q\n", buf.String())
+	}
+	if err := e.Unique("users", "a b"); err != ErrName {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrName)
+	}
+}
@@ -2,19 +2,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/ryandotsmith/l2met/api"
 	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/bucket"
 	"github.com/ryandotsmith/l2met/conf"
 	"github.com/ryandotsmith/l2met/metchan"
 	"github.com/ryandotsmith/l2met/outlet"
+	"github.com/ryandotsmith/l2met/prom"
 	"github.com/ryandotsmith/l2met/reader"
 	"github.com/ryandotsmith/l2met/receiver"
+	"github.com/ryandotsmith/l2met/statsd"
 	"github.com/ryandotsmith/l2met/store"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 )
 
 // Hold onto the app's global config.
@@ -34,6 +42,26 @@ func main() {
 		fmt.Println(conf.Version)
 		os.Exit(0)
 	}
+	bucket.Accuracy = cfg.SketchAccuracy
+	bucket.ExactValues = cfg.SketchValues
+
+	// The pipe command does not deal with drains,
+	// so it has no need for secrets.
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "pipe" {
+		os.Exit(pipeCmd(args[1:]))
+	}
+	if len(cfg.Secrets) == 0 {
+		log.Fatal("Must set: SECRETS")
+	}
+	if len(args) > 0 {
+		switch args[0] {
+		case "replay":
+			os.Exit(replayCmd(args[1:], os.Stdout, os.Stderr))
+		default:
+			log.Fatalf("Unknown command %q.", args[0])
+		}
+	}
 
 	// Can be passed to other modules
 	// as an internal metrics channel.
@@ -48,30 +76,99 @@ func main() {
 		st = redisStore
 		fmt.Printf("at=initialized-redis-store\n")
 	} else {
-		st = store.NewMemStore()
+		memStore := store.NewMemStore()
+		memStore.Clock = cfg.Clock
+		st = memStore
 		fmt.Printf("at=initialized-mem-store\n")
 	}
+	storeClock := store.NewClock(cfg, st)
+	storeClock.Mchan = mchan
+	storeClock.Start()
 
+	var out *outlet.LibratoOutlet
 	if cfg.UseOutlet {
 		rdr := reader.New(cfg, st)
 		rdr.Mchan = mchan
-		outlet := outlet.NewLibratoOutlet(cfg, rdr)
-		outlet.Mchan = mchan
-		outlet.Start()
+		rdr.StoreClock = storeClock
+		out = outlet.NewLibratoOutlet(cfg, rdr)
+		out.Mchan = mchan
+		out.Start()
 	}
 
+	var recv *receiver.Receiver
+	var sd *statsd.Listener
 	if cfg.UsingReciever {
-		recv := receiver.NewReceiver(cfg, st)
+		recv = receiver.NewReceiver(cfg, st)
 		recv.Mchan = mchan
+		recv.StoreClock = storeClock
 		recv.Start()
+		go recv.Report()
 		http.Handle("/logs", recv)
+		ah := api.NewHandler(cfg, recv)
+		ah.Mchan = mchan
+		http.Handle("/metrics", ah)
+		if cfg.UsingPrometheus {
+			ph := prom.NewHandler(cfg, recv)
+			ph.Mchan = mchan
+			http.Handle("/prometheus", ph)
+		}
+		if cfg.UsingStatsd {
+			sd = statsd.NewListener(cfg, recv)
+			sd.Mchan = mchan
+			if err := sd.Start(); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("at=initialized-statsd addr=%s\n", cfg.StatsdAddr)
+		}
 	}
 
 	http.Handle("/health", st)
 	http.HandleFunc("/sign", auth.ServeHTTP)
-	e := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), nil)
-	if e != nil {
-		log.Fatal("Unable to start HTTP server.")
-	}
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}
+	go func() {
+		e := srv.ListenAndServe()
+		if e != nil && e != http.ErrServerClosed {
+			log.Fatal("Unable to start HTTP server.")
+		}
+	}()
 	fmt.Printf("at=l2met-initialized port=%d\n", cfg.Port)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	<-sig
+	fmt.Printf("at=l2met-shutdown timeout=%s\n", cfg.ShutdownTimeout)
+	done := make(chan struct{})
+	go func() {
+		shutdown(srv, sd, recv, out)
+		close(done)
+	}()
+	select {
+	case <-done:
+		fmt.Printf("at=l2met-shutdown-complete\n")
+	case <-time.After(cfg.ShutdownTimeout):
+		fmt.Printf("error=l2met-shutdown-timeout\n")
+		os.Exit(1)
+	}
+}
+
+// Drains the pipeline from front to back. Once the HTTP server
+// has stopped, the receiver can parse the requests in its inbox
+// and flush its register to the store. The outlet then finishes
+// delivering the buckets it has already read from the store.
+// Buckets that are not yet ready remain in the store for the next process.
+func shutdown(srv *http.Server, sd *statsd.Listener, recv *receiver.Receiver, out *outlet.LibratoOutlet) {
+	if err := srv.Shutdown(context.Background()); err != nil {
+		fmt.Printf("at=http-shutdown error=%s\n", err)
+	}
+	if sd != nil {
+		sd.Stop()
+	}
+	if recv != nil {
+		recv.Stop()
+		fmt.Printf("at=receiver-drained\n")
+	}
+	if out != nil {
+		out.Stop()
+		fmt.Printf("at=outlet-drained\n")
+	}
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
 	"github.com/ryandotsmith/l2met/conf"
 	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/reader"
 	"github.com/ryandotsmith/l2met/receiver"
 	"github.com/ryandotsmith/l2met/store"
 	"testing"
@@ -191,7 +194,9 @@ func receiveInput(opts testOps, msg []byte) ([]*bucket.Bucket, error) {
 	recv := receiver.NewReceiver(cfg, st)
 	recv.Mchan = new(metchan.Channel)
 	recv.Start()
-	recv.Receive(msg, opts)
+	if err := recv.Receive(msg, opts); err != nil {
+		return nil, err
+	}
 	recv.Wait()
 	d, err := time.ParseDuration(opts["resolution"][0] + "s")
 	if err != nil {
@@ -217,8 +222,53 @@ func bucketsEqual(actual, expected *bucket.Bucket) bool {
 	if actual.Id.Source != expected.Id.Source {
 		return false
 	}
-	if actual.Sum != expected.Sum {
+	if actual.Sum() != expected.Sum() {
 		return false
 	}
 	return true
 }
+
+// The aggregation windows follow the simulated clock,
+// regardless of how much real time has passed.
+func TestSimulatedClock(t *testing.T) {
+	start := time.Date(2013, 5, 7, 12, 0, 0, 0, time.UTC)
+	sim := clock.NewSim(start)
+	cfg := &conf.D{
+		Concurrency:      1,
+		BufferSize:       10,
+		FlushInterval:    time.Second,
+		OutletInterval:   time.Second,
+		ReceiverDeadline: 2,
+		Clock:            sim,
+	}
+	st := store.NewMemStore()
+	st.Clock = sim
+	recv := receiver.NewReceiver(cfg, st)
+	recv.Mchan = new(metchan.Channel)
+	recv.Start()
+	rdr := reader.New(cfg, st)
+	rdr.Mchan = new(metchan.Channel)
+	out := make(chan *bucket.Bucket, 10)
+	rdr.Start(out)
+
+	body := receiver.NewBody(bytes.NewReader(fmtLog(start, "app", "measure#a=1")), 0)
+	if err := recv.ReceiveStream(body, opts); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	for i := 0; i < 120; i++ {
+		sim.Add(time.Second)
+		select {
+		case b := <-out:
+			rdr.Done()
+			if sim.Now().Before(start.Add(time.Minute)) {
+				t.Fatalf("Bucket read before its interval ended. now=%s\n", sim.Now())
+			}
+			if b.Id.Name != "a" || !b.Id.Time.Equal(start) {
+				t.Fatalf("actual=%s@%s expected=a@%s\n", b.Id.Name, b.Id.Time, start)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatalf("Expected bucket to be read by %s\n", sim.Now())
+}
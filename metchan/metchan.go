@@ -9,7 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
 	"github.com/ryandotsmith/l2met/conf"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -38,6 +40,9 @@ type Channel struct {
 	source   string
 	appName  string
 	numOutlets int
+	clock    clock.Clock
+	// Diagnostics are written here. Defaults to stdout.
+	Log io.Writer
 }
 
 // Returns an initialized Metchan Channel.
@@ -64,6 +69,7 @@ func New(cfg *conf.D) *Channel {
 
 	// This will enable writting to a logger.
 	c.verbose = cfg.Verbose
+	c.Log = cfg.Log
 
 	// Internal Datastructures.
 	c.Buffer = make(map[string]*bucket.Bucket)
@@ -77,6 +83,7 @@ func New(cfg *conf.D) *Channel {
 		c.source = host
 	}
 	c.appName = cfg.AppName
+	c.clock = clock.Default(cfg.Clock)
 	return c
 }
 
@@ -97,9 +104,19 @@ func (c *Channel) Time(name string, t time.Time) {
 	c.Measure(name, float64(elapsed))
 }
 
+// Writes a diagnostic to Log. Components that publish
+// to the channel log through it as well.
+func (c *Channel) Printf(format string, a ...interface{}) {
+	var w io.Writer = os.Stdout
+	if c != nil && c.Log != nil {
+		w = c.Log
+	}
+	fmt.Fprintf(w, format, a...)
+}
+
 func (c *Channel) Measure(name string, v float64) {
 	if c.verbose {
-		fmt.Printf("source=%s measure#%s=%f\n", c.source, name, v)
+		c.Printf("source=%s measure#%s=%f\n", c.source, name, v)
 	}
 	if !c.Enabled {
 		return
@@ -116,19 +133,35 @@ func (c *Channel) Measure(name string, v float64) {
 }
 
 func (c *Channel) CountReq(user string) {
+	c.countUser("receiver.requests", "requests", user, 1)
+}
+
+// Count a request that was turned away by the receiver.
+// E.g. reason=inbox-full or reason=tenant-limit
+func (c *Channel) CountReject(user, reason string) {
+	c.countUser("receiver.rejects."+reason, "requests", user, 1)
+}
+
+// Count buckets that the receiver did not keep.
+// E.g. reason=deadline or reason=retention
+func (c *Channel) CountDrop(user, reason string, n int) {
+	c.countUser("receiver.drops."+reason, "buckets", user, float64(n))
+}
+
+func (c *Channel) countUser(name, units, user string, n float64) {
 	if !c.Enabled {
 		return
 	}
 	usr := strings.Replace(user, "@", "_at_", -1)
 	id := &bucket.Id{
 		Resolution: c.FlushInterval,
-		Name:       c.appName + "." + "receiver.requests",
-		Units:      "requests",
+		Name:       c.appName + "." + name,
+		Units:      units,
 		Source:     usr,
 		Type:       "counter",
 	}
 	b := c.getBucket(id)
-	b.Incr(1)
+	b.Append(n)
 }
 
 func (c *Channel) getBucket(id *bucket.Id) *bucket.Bucket {
@@ -145,7 +178,8 @@ func (c *Channel) getBucket(id *bucket.Id) *bucket.Bucket {
 	// We will re-use the old bucket and reset the slice. This
 	// dramatically decreases the amount of arrays created and thus
 	// led to better memory utilization.
-	latest := time.Now().Truncate(c.FlushInterval)
+	// Channels are often built with new(Channel) in tests.
+	latest := clock.Default(c.clock).Now().Truncate(c.FlushInterval)
 	if b.Id.Time != latest {
 		b.Id.Time = latest
 		b.Reset()
@@ -154,7 +188,7 @@ func (c *Channel) getBucket(id *bucket.Id) *bucket.Bucket {
 }
 
 func (c *Channel) scheduleFlush() {
-	for _ = range time.Tick(c.FlushInterval) {
+	for _ = range c.clock.NewTicker(c.FlushInterval).C {
 		c.flush()
 	}
 }
@@ -167,7 +201,7 @@ func (c *Channel) flush() {
 			select {
 			case c.outbox <- m:
 			default:
-				fmt.Printf("error=metchan-drop\n")
+				c.Printf("error=metchan-drop\n")
 			}
 		}
 	}
@@ -176,7 +210,7 @@ func (c *Channel) flush() {
 func (c *Channel) outlet() {
 	for met := range c.outbox {
 		if err := c.post(met); err != nil {
-			fmt.Printf("at=metchan-post error=%s\n", err)
+			c.Printf("at=metchan-post error=%s\n", err)
 		}
 	}
 }
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"github.com/ryandotsmith/l2met/auth"
 	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
 	"github.com/ryandotsmith/l2met/conf"
 	"github.com/ryandotsmith/l2met/metchan"
 	"github.com/ryandotsmith/l2met/reader"
@@ -18,11 +19,15 @@ import (
 	"net/http"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 var libratoUrl = "https://metrics-api.librato.com/v1/metrics"
 
+// The max number of metrics in a single Librato request.
+const maxPayload = 300
+
 type libratoRequest struct {
 	Gauges []*bucket.LibratoMetric `json:"gauges"`
 }
@@ -35,7 +40,10 @@ type LibratoOutlet struct {
 	rdr         *reader.Reader
 	conn        *http.Client
 	numRetries  int
+	clock       clock.Clock
 	Mchan       *metchan.Channel
+	// Counts metrics that have been converted but not yet posted.
+	pending sync.WaitGroup
 }
 
 func buildClient(ttl time.Duration) *http.Client {
@@ -61,6 +69,7 @@ func NewLibratoOutlet(cfg *conf.D, r *reader.Reader) *LibratoOutlet {
 	l.numOutlets = cfg.Concurrency
 	l.numRetries = cfg.OutletRetries
 	l.rdr = r
+	l.clock = clock.Default(cfg.Clock)
 	return l
 }
 
@@ -80,16 +89,21 @@ func (l *LibratoOutlet) Start() {
 
 func (l *LibratoOutlet) convert() {
 	for bucket := range l.inbox {
-		for _, m := range bucket.Metrics() {
+		metrics := bucket.Metrics()
+		// Account for the metrics before we release the bucket
+		// so that Stop never sees an empty pipeline by mistake.
+		l.pending.Add(len(metrics))
+		l.rdr.Done()
+		for _, m := range metrics {
 			l.conversions <- m
 		}
-		delay := bucket.Id.Delay(time.Now())
+		delay := bucket.Id.Delay(l.clock.Now())
 		l.Mchan.Measure("outlet.delay", float64(delay))
 	}
 }
 
 func (l *LibratoOutlet) groupByUser() {
-	ticker := time.Tick(time.Millisecond * 200)
+	ticker := l.clock.NewTicker(time.Millisecond * 200).C
 	m := make(map[string][]*bucket.LibratoMetric)
 	for {
 		select {
@@ -103,7 +117,7 @@ func (l *LibratoOutlet) groupByUser() {
 		case payload := <-l.conversions:
 			usr := payload.Auth
 			if _, present := m[usr]; !present {
-				m[usr] = make([]*bucket.LibratoMetric, 1, 300)
+				m[usr] = make([]*bucket.LibratoMetric, 1, maxPayload)
 				m[usr][0] = payload
 			} else {
 				m[usr] = append(m[usr], payload)
@@ -116,41 +130,73 @@ func (l *LibratoOutlet) groupByUser() {
 	}
 }
 
+// Stops reading from the store and waits for the
+// buckets that have been read to be posted to Librato.
+func (l *LibratoOutlet) Stop() {
+	l.rdr.Stop()
+	l.pending.Wait()
+}
+
 func (l *LibratoOutlet) outlet() {
 	for payloads := range l.outbox {
-		if len(payloads) < 1 {
-			fmt.Printf("at=%q\n", "empty-metrics-error")
-			continue
-		}
-		//Since a playload contains all metrics for
-		//a unique librato user/pass, we can extract the user/pass
-		//from any one of the payloads.
-		decr, err := auth.Decrypt(payloads[0].Auth)
-		if err != nil {
-			fmt.Printf("error=%s\n", err)
-			continue
-		}
-		creds := strings.Split(decr, ":")
-		if len(creds) != 2 {
-			fmt.Printf("error=missing-creds\n")
-			continue
-		}
-		libratoReq := &libratoRequest{payloads}
-		j, err := json.Marshal(libratoReq)
-		if err != nil {
-			fmt.Printf("at=json error=%s user=%s\n", err, creds[0])
-			continue
-		}
-		if err := l.postWithRetry(creds[0], creds[1], j); err != nil {
-			l.Mchan.Measure("outlet.drop", 1)
+		l.deliver(payloads)
+		l.pending.Add(-len(payloads))
+	}
+}
+
+// Posts the metrics to Librato, grouped by user. This is used to
+// deliver metrics that did not come from the reader (e.g. replays).
+// Returns once all of the metrics have been posted.
+func (l *LibratoOutlet) Deliver(metrics []*bucket.LibratoMetric) {
+	groups := make(map[string][]*bucket.LibratoMetric)
+	for _, m := range metrics {
+		groups[m.Auth] = append(groups[m.Auth], m)
+	}
+	for _, g := range groups {
+		for len(g) > 0 {
+			n := len(g)
+			if n > maxPayload {
+				n = maxPayload
+			}
+			l.deliver(g[:n])
+			g = g[n:]
 		}
 	}
 }
 
+func (l *LibratoOutlet) deliver(payloads []*bucket.LibratoMetric) {
+	if len(payloads) < 1 {
+		l.Mchan.Printf("at=%q\n", "empty-metrics-error")
+		return
+	}
+	//Since a playload contains all metrics for
+	//a unique librato user/pass, we can extract the user/pass
+	//from any one of the payloads.
+	decr, err := auth.Decrypt(payloads[0].Auth)
+	if err != nil {
+		l.Mchan.Printf("error=%s\n", err)
+		return
+	}
+	creds := strings.Split(decr, ":")
+	if len(creds) != 2 {
+		l.Mchan.Printf("error=missing-creds\n")
+		return
+	}
+	libratoReq := &libratoRequest{payloads}
+	j, err := json.Marshal(libratoReq)
+	if err != nil {
+		l.Mchan.Printf("at=json error=%s user=%s\n", err, creds[0])
+		return
+	}
+	if err := l.postWithRetry(creds[0], creds[1], j); err != nil {
+		l.Mchan.Measure("outlet.drop", 1)
+	}
+}
+
 func (l *LibratoOutlet) postWithRetry(u, p string, body []byte) error {
 	for i := 0; i <= l.numRetries; i++ {
 		if err := l.post(u, p, body); err != nil {
-			fmt.Printf("measure.librato.error user=%s msg=%s attempt=%d\n", u, err, i)
+			l.Mchan.Printf("measure.librato.error user=%s msg=%s attempt=%d\n", u, err, i)
 			if i == l.numRetries {
 				return err
 			}
@@ -195,7 +241,7 @@ func (l *LibratoOutlet) post(u, p string, body []byte) error {
 // Keep an eye on the lenghts of our bufferes.
 // If they are maxed out, something is going wrong.
 func (l *LibratoOutlet) Report() {
-	for _ = range time.Tick(time.Second) {
+	for _ = range l.clock.NewTicker(time.Second).C {
 		pre := "librato-outlet."
 		l.Mchan.Measure(pre+"inbox", float64(len(l.inbox)))
 		l.Mchan.Measure(pre+"conversion", float64(len(l.conversions)))
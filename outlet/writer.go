@@ -0,0 +1,60 @@
+package outlet
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+	"io"
+	"strconv"
+)
+
+// Writes the metrics to w, one per line, in the given format.
+// Supported formats are logfmt and json. Used by the commands
+// that run l2met without Librato.
+func WriteMetrics(w io.Writer, format string, metrics []*bucket.LibratoMetric) error {
+	for _, m := range metrics {
+		var err error
+		switch format {
+		case "json":
+			err = json.NewEncoder(w).Encode(m)
+		case "logfmt":
+			_, err = fmt.Fprintln(w, logfmt(m))
+		default:
+			return fmt.Errorf("outlet: unknown format %q", format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logfmt(m *bucket.LibratoMetric) string {
+	s := fmt.Sprintf("measure_time=%d name=%s", m.Time, m.Name)
+	if len(m.Source) > 0 {
+		s += " source=" + m.Source
+	}
+	if m.Val != nil {
+		s += " value=" + fmtFloat(*m.Val)
+	}
+	if m.Count != nil {
+		s += " count=" + strconv.Itoa(*m.Count)
+	}
+	if m.Sum != nil {
+		s += " sum=" + fmtFloat(*m.Sum)
+	}
+	if m.Min != nil {
+		s += " min=" + fmtFloat(*m.Min)
+	}
+	if m.Max != nil {
+		s += " max=" + fmtFloat(*m.Max)
+	}
+	if m.Attr != nil && len(m.Attr.Units) > 0 {
+		s += " units=" + m.Attr.Units
+	}
+	return s
+}
+
+func fmtFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
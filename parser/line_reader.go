@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/bmizerany/lpx"
+)
+
+// Lines longer than this are skipped.
+const maxLineSize = 64 << 10
+
+// Reads one message per line. This is used for logs that were
+// not framed by logplex, e.g. a log file piped into l2met.
+// Lines that start with a syslog priority (e.g. <190>1) are
+// read as RFC5424. Other lines are read as plain logfmt with
+// an empty header, so their time is the time of reading.
+type lineReader struct {
+	rdr *bufio.Reader
+	hdr *lpx.Header
+	msg []byte
+}
+
+func newLineReader(body *bufio.Reader) *lineReader {
+	return &lineReader{rdr: bufio.NewReaderSize(body, maxLineSize)}
+}
+
+func (r *lineReader) Next() bool {
+	for {
+		line, err := r.rdr.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = r.rdr.ReadSlice('\n')
+			}
+			if err != nil {
+				return false
+			}
+			continue
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			r.hdr, r.msg = splitSyslog(line)
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+func (r *lineReader) Header() *lpx.Header {
+	return r.hdr
+}
+
+func (r *lineReader) Bytes() []byte {
+	return r.msg
+}
+
+// <prival>version timestamp hostname app-name procid msgid msg
+func splitSyslog(line []byte) (*lpx.Header, []byte) {
+	if line[0] != '<' {
+		return new(lpx.Header), line
+	}
+	f := bytes.SplitN(line, []byte(" "), 7)
+	if len(f) < 7 {
+		return new(lpx.Header), line
+	}
+	hdr := &lpx.Header{
+		PrivalVersion: f[0],
+		Time:          f[1],
+		Hostname:      f[2],
+		Name:          f[3],
+		Procid:        f[4],
+		Msgid:         f[5],
+	}
+	return hdr, f[6]
+}
@@ -4,7 +4,6 @@ package parser
 
 import (
 	"bufio"
-	"fmt"
 	"github.com/bmizerany/lpx"
 	"github.com/ryandotsmith/l2met/auth"
 	"github.com/ryandotsmith/l2met/bucket"
@@ -26,22 +25,45 @@ var (
 	measurePrefix = "measure#"
 	samplePrefix  = "sample#"
 	counterPrefix = "count#"
+	totalPrefix   = "total#"
+	uniquePrefix  = "unique#"
+	histPrefix    = "histogram#"
 )
 
+// A source of log messages and their syslog headers.
+type msgReader interface {
+	Next() bool
+	Bytes() []byte
+	Header() *lpx.Header
+}
+
 type parser struct {
 	out   chan *bucket.Bucket
-	lr    *lpx.Reader
+	lr    msgReader
 	ld    *logData
 	opts  options
 	mchan *metchan.Channel
+	now   func() time.Time
+}
+
+// Reads octet counted syslog messages as sent by logplex.
+// Lines without a valid timestamp are given the time returned by now.
+func BuildBuckets(body *bufio.Reader, opts options, m *metchan.Channel, now func() time.Time) <-chan *bucket.Bucket {
+	return build(lpx.NewReader(body), opts, m, now)
 }
 
-func BuildBuckets(body *bufio.Reader, opts options, m *metchan.Channel) <-chan *bucket.Bucket {
+// Reads one message per line. See lineReader for details.
+func BuildLineBuckets(body *bufio.Reader, opts options, m *metchan.Channel, now func() time.Time) <-chan *bucket.Bucket {
+	return build(newLineReader(body), opts, m, now)
+}
+
+func build(lr msgReader, opts options, m *metchan.Channel, now func() time.Time) <-chan *bucket.Bucket {
 	p := new(parser)
 	p.mchan = m
+	p.now = now
 	p.opts = opts
 	p.out = make(chan *bucket.Bucket)
-	p.lr = lpx.NewReader(body)
+	p.lr = lr
 	p.ld = NewLogData()
 	go p.parse()
 	return p.out
@@ -55,11 +77,14 @@ func (p *parser) parse() {
 		}
 		p.ld.Reset()
 		if err := p.ld.Read(p.lr.Bytes()); err != nil {
-			fmt.Printf("error=%s\n", err)
+			p.mchan.Printf("error=%s\n", err)
 			continue
 		}
 		for _, t := range p.ld.Tuples {
 			p.handleCounters(t)
+			p.handleTotals(t)
+			p.handleUniques(t)
+			p.handleHistograms(t)
 			p.handleSamples(t)
 			p.handleHkRouter(t)
 			p.handlMeasurements(t)
@@ -128,6 +153,55 @@ func (p *parser) handlMeasurements(t *tuple) error {
 	return nil
 }
 
+// Running totals are converted to counters by the receiver.
+func (p *parser) handleTotals(t *tuple) error {
+	if !strings.HasPrefix(t.Name(), totalPrefix) {
+		return nil
+	}
+	id := new(bucket.Id)
+	p.buildId(id, t)
+	id.Type = "total"
+	val, err := t.Float64()
+	if err != nil {
+		return err
+	}
+	p.out <- &bucket.Bucket{Id: id, Vals: []float64{val}}
+	return nil
+}
+
+// The value of a unique is not a number. E.g. unique#users=u-1234
+func (p *parser) handleUniques(t *tuple) error {
+	if !strings.HasPrefix(t.Name(), uniquePrefix) || len(t.Val) == 0 {
+		return nil
+	}
+	id := new(bucket.Id)
+	p.buildId(id, t)
+	id.Type = "unique"
+	id.Units = ""
+	b := &bucket.Bucket{Id: id}
+	b.AddUnique(t.Val)
+	p.out <- b
+	return nil
+}
+
+func (p *parser) handleHistograms(t *tuple) error {
+	if !strings.HasPrefix(t.Name(), histPrefix) {
+		return nil
+	}
+	id := new(bucket.Id)
+	p.buildId(id, t)
+	id.Type = "histogram"
+	id.Bounds, _ = Bounds(p.opts)
+	val, err := t.Float64()
+	if err != nil {
+		return err
+	}
+	b := &bucket.Bucket{Id: id}
+	b.Observe(val)
+	p.out <- b
+	return nil
+}
+
 func (p *parser) handleHkLogplexErr() bool {
 	if string(p.lr.Header().Procid) != logplexPrefix {
 		return false
@@ -142,7 +216,7 @@ func (p *parser) handleHkLogplexErr() bool {
 	}
 	if decr, err := auth.Decrypt(p.Auth()); err == nil {
 		user := strings.Split(decr, ":")[0]
-		fmt.Printf("error=logplex.l10 drops=%d user=%s\n", numDrops, user)
+		p.mchan.Printf("error=logplex.l10 drops=%d user=%s\n", numDrops, user)
 	}
 	p.mchan.Measure("logplex.l10", float64(numDrops))
 	return true
@@ -181,18 +255,15 @@ func (p *parser) buildId(id *bucket.Id, t *tuple) {
 	id.Name = p.Prefix(t.Name())
 	id.Units = t.Units()
 	id.Source = p.SourcePrefix(p.ld.Source())
+	id.Percentiles, _ = Percentiles(p.opts)
+	id.PercentileMethod, _ = PercentileMethod(p.opts)
+	id.Mean, _ = Mean(p.opts)
+	id.Rate, _ = Rate(p.opts)
 	return
 }
 
 func (p *parser) SourcePrefix(suffix string) string {
-	pre, present := p.opts["source-prefix"]
-	if !present {
-		return suffix
-	}
-	if len(suffix) > 0 {
-		return pre[0] + "." + suffix
-	}
-	return pre[0]
+	return SourcePrefix(p.opts, suffix)
 }
 
 func (p *parser) Prefix(suffix string) string {
@@ -209,15 +280,24 @@ func (p *parser) Prefix(suffix string) string {
 	if strings.HasPrefix(suffix, samplePrefix) {
 		suffix = suffix[len(samplePrefix):]
 	}
-	pre, present := p.opts["prefix"]
-	if !present {
-		return suffix
+	if strings.HasPrefix(suffix, totalPrefix) {
+		suffix = suffix[len(totalPrefix):]
+	}
+	if strings.HasPrefix(suffix, uniquePrefix) {
+		suffix = suffix[len(uniquePrefix):]
+	}
+	if strings.HasPrefix(suffix, histPrefix) {
+		suffix = suffix[len(histPrefix):]
 	}
-	return pre[0] + "." + suffix
+	return Prefix(p.opts, suffix)
 }
 
+// Bodies queued without options (e.g. by Receive) have no auth.
 func (p *parser) Auth() string {
-	return p.opts["auth"][0]
+	if auth, present := p.opts["auth"]; present && len(auth) > 0 {
+		return auth[0]
+	}
+	return ""
 }
 
 func (p *parser) Time() time.Time {
@@ -225,19 +305,132 @@ func (p *parser) Time() time.Time {
 	d := p.Resolution()
 	t, err := time.Parse(time.RFC3339, ts)
 	if err != nil {
-		t = time.Now()
+		t = p.now()
 	}
 	return time.Unix(0, int64((time.Duration(t.UnixNano())/d)*d))
 }
 
 func (p *parser) Resolution() time.Duration {
-	resTmp, present := p.opts["resolution"]
+	return Resolution(p.opts)
+}
+
+// Prepends the source-prefix option, if present, to the source.
+func SourcePrefix(opts map[string][]string, suffix string) string {
+	pre, present := opts["source-prefix"]
+	if !present {
+		return suffix
+	}
+	if len(suffix) > 0 {
+		return pre[0] + "." + suffix
+	}
+	return pre[0]
+}
+
+// Prepends the prefix option, if present, to the metric name.
+func Prefix(opts map[string][]string, name string) string {
+	pre, present := opts["prefix"]
+	if !present {
+		return name
+	}
+	return pre[0] + "." + name
+}
+
+// Returns the first error found in the options that control
+// how buckets are emitted. The parser ignores invalid options,
+// so receivers use this to reject them up front.
+func CheckOptions(opts map[string][]string) error {
+	if _, err := Percentiles(opts); err != nil {
+		return err
+	}
+	if _, err := PercentileMethod(opts); err != nil {
+		return err
+	}
+	if _, err := Mean(opts); err != nil {
+		return err
+	}
+	if _, err := Rate(opts); err != nil {
+		return err
+	}
+	_, err := Bounds(opts)
+	return err
+}
+
+// Reads the percentiles option. E.g. percentiles=50,75,99.9
+// Returns an empty string, which means the default percentiles,
+// if the option is missing or invalid.
+func Percentiles(opts map[string][]string) (string, error) {
+	s, present := opts["percentiles"]
+	if !present {
+		return "", nil
+	}
+	ps, err := bucket.ParsePercentiles(s[0])
+	if err != nil {
+		return "", err
+	}
+	return bucket.FormatPercentiles(ps), nil
+}
+
+// Reads the percentile-method option. E.g. percentile-method=linear
+// Returns an empty string, which means the default method,
+// if the option is missing or invalid.
+func PercentileMethod(opts map[string][]string) (string, error) {
+	m, present := opts["percentile-method"]
+	if !present {
+		return "", nil
+	}
+	if err := bucket.CheckPercentileMethod(m[0]); err != nil {
+		return "", err
+	}
+	return m[0], nil
+}
+
+// Reads the mean option. E.g. mean=true
+func Mean(opts map[string][]string) (bool, error) {
+	m, present := opts["mean"]
+	if !present {
+		return false, nil
+	}
+	return strconv.ParseBool(m[0])
+}
+
+// Reads the rate option. E.g. rate=also or rate=only
+// Returns an empty string, which means the sum alone,
+// if the option is missing or invalid.
+func Rate(opts map[string][]string) (string, error) {
+	r, present := opts["rate"]
+	if !present {
+		return "", nil
+	}
+	if err := bucket.CheckRate(r[0]); err != nil {
+		return "", err
+	}
+	return r[0], nil
+}
+
+// Reads the bounds option for histograms. E.g. bounds=100,300,1000
+// Returns an empty string, which means the default bounds,
+// if the option is missing or invalid.
+func Bounds(opts map[string][]string) (string, error) {
+	s, present := opts["bounds"]
+	if !present {
+		return "", nil
+	}
+	bs, err := bucket.ParseBounds(s[0])
+	if err != nil {
+		return "", err
+	}
+	return bucket.FormatBounds(bs), nil
+}
+
+// Reads the resolution option given in seconds. Defaults to 60s.
+func Resolution(opts map[string][]string) time.Duration {
+	resTmp, present := opts["resolution"]
 	if !present {
 		resTmp = []string{"60"}
 	}
 
 	res, err := strconv.Atoi(resTmp[0])
-	if err != nil {
+	if err != nil || res <= 0 {
 		return time.Minute
 	}
 
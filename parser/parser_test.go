@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"github.com/ryandotsmith/l2met/bucket"
 	"github.com/ryandotsmith/l2met/metchan"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testCase struct {
@@ -47,7 +49,7 @@ func TestBuildBuckets(t *testing.T) {
 		mchan.Buffer = make(map[string]*bucket.Bucket)
 		body := bufio.NewReader(bytes.NewBufferString(tc.in))
 		buckets := make([]*bucket.Bucket, 0)
-		for b := range BuildBuckets(body, tc.opts, mchan) {
+		for b := range BuildBuckets(body, tc.opts, mchan, time.Now) {
 			buckets = append(buckets, b)
 		}
 		if len(tc.names) > 0 {
@@ -86,3 +88,112 @@ func testNames(t *testing.T, b []*bucket.Bucket, tc testCase) {
 		}
 	}
 }
+
+func TestBuildLineBucketsSkipsLongLines(t *testing.T) {
+	long := "measure#x=" + strings.Repeat("1", maxLineSize)
+	in := long + "\nmeasure#a=1\n\nmeasure#b=2"
+	body := bufio.NewReader(strings.NewReader(in))
+	opts := options{"auth": []string{""}}
+	var names []string
+	for b := range BuildLineBuckets(body, opts, new(metchan.Channel), time.Now) {
+		names = append(names, b.Id.Name)
+	}
+	if strings.Join(names, ",") != "a,b" {
+		t.Fatalf("actual=%v expected=[a b]\n", names)
+	}
+}
+
+func TestPercentilesOption(t *testing.T) {
+	in := `88 <174>1 2013-07-22T00:06:26-00:00 somehost name test - measure#hello=1 measure#world=1ms\n`
+	opts := options{"auth": []string{"abc123"}, "percentiles": []string{"99.9,75"}}
+	body := bufio.NewReader(strings.NewReader(in))
+	for b := range BuildBuckets(body, opts, new(metchan.Channel), time.Now) {
+		if b.Id.Percentiles != "75,99.9" {
+			t.Fatalf("actual=%q expected=%q\n", b.Id.Percentiles, "75,99.9")
+		}
+	}
+	opts["percentiles"] = []string{"101"}
+	if _, err := Percentiles(opts); err != bucket.ErrPercentiles {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, bucket.ErrPercentiles)
+	}
+}
+
+func TestPercentileMethodOption(t *testing.T) {
+	opts := options{"percentile-method": []string{"linear"}}
+	if m, err := PercentileMethod(opts); m != bucket.Linear || err != nil {
+		t.Fatalf("actual=%q,%v expected=%q\n", m, err, bucket.Linear)
+	}
+	opts["percentile-method"] = []string{"median"}
+	if _, err := PercentileMethod(opts); err != bucket.ErrPercentileMethod {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, bucket.ErrPercentileMethod)
+	}
+	if m, _ := PercentileMethod(options{}); m != "" {
+		t.Fatalf("actual=%q expected default\n", m)
+	}
+}
+
+func TestMeanOption(t *testing.T) {
+	if m, err := Mean(options{"mean": []string{"true"}}); !m || err != nil {
+		t.Fatalf("actual=%t,%v expected=true\n", m, err)
+	}
+	if _, err := Mean(options{"mean": []string{"sure"}}); err == nil {
+		t.Fatalf("Expected an error for an invalid mean option.")
+	}
+	if m, _ := Mean(options{}); m {
+		t.Fatalf("Expected mean to be off by default.")
+	}
+}
+
+var checkOptionsTest = []struct {
+	opts options
+	err  bool
+}{
+	{options{}, false},
+	{options{"rate": []string{"only"}, "mean": []string{"1"}}, false},
+	{options{"rate": []string{"daily"}}, true},
+	{options{"percentiles": []string{"200"}}, true},
+	{options{"percentile-method": []string{"max"}}, true},
+	{options{"mean": []string{"maybe"}}, true},
+}
+
+func TestCheckOptions(t *testing.T) {
+	for _, ts := range checkOptionsTest {
+		if err := CheckOptions(ts.opts); (err != nil) != ts.err {
+			t.Fatalf("opts=%v actual-err=%v\n", ts.opts, err)
+		}
+	}
+}
+
+func TestBuildUniques(t *testing.T) {
+	in := "unique#users=a unique#users=b\nunique#users=a unique#users\n"
+	body := bufio.NewReader(strings.NewReader(in))
+	merged := &bucket.Bucket{Id: new(bucket.Id)}
+	for b := range BuildLineBuckets(body, options{"auth": []string{""}}, new(metchan.Channel), time.Now) {
+		if b.Id.Name != "users" || b.Id.Type != "unique" {
+			t.Fatalf("actual=%s,%s expected=users,unique\n", b.Id.Name, b.Id.Type)
+		}
+		merged.Merge(b)
+	}
+	if merged.Uniques.Count() != 2 {
+		t.Fatalf("actual=%d expected=2\n", merged.Uniques.Count())
+	}
+}
+
+func TestBuildHistograms(t *testing.T) {
+	in := "histogram#lat=120ms histogram#lat=350ms\n"
+	body := bufio.NewReader(strings.NewReader(in))
+	opts := options{"auth": []string{""}, "bounds": []string{"300,100"}}
+	merged := &bucket.Bucket{Id: new(bucket.Id)}
+	for b := range BuildLineBuckets(body, opts, new(metchan.Channel), time.Now) {
+		if b.Id.Name != "lat" || b.Id.Type != "histogram" || b.Id.Bounds != "100,300" {
+			t.Fatalf("actual=%+v\n", b.Id)
+		}
+		merged.Merge(b)
+	}
+	if c := merged.Hist.Cumulative(); c[0] != 0 || c[1] != 1 || merged.Hist.Count() != 2 {
+		t.Fatalf("actual=%v,%d expected=[0 1],2\n", c, merged.Hist.Count())
+	}
+	if err := CheckOptions(options{"bounds": []string{"a,b"}}); err != bucket.ErrBounds {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, bucket.ErrBounds)
+	}
+}
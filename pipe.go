@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/parser"
+	"github.com/ryandotsmith/l2met/pipe"
+	"os"
+	"strconv"
+	"time"
+)
+
+// l2met pipe [-resolution 60s] [-prefix p] [-percentiles 50,99]
+// [-percentile-method nearest-rank|linear] [-mean] [-rate also|only]
+// [-bounds 100,300] [-format logfmt|json] < app.log
+func pipeCmd(args []string) int {
+	fs := flag.NewFlagSet("pipe", flag.ExitOnError)
+	res := fs.Duration("resolution", time.Minute,
+		"Aggregate lines into buckets of this duration. Must be whole seconds.")
+	prefix := fs.String("prefix", "",
+		"Prepend this value to metric names.")
+	percentiles := fs.String("percentiles", "",
+		"Comma separated percentiles to emit for measurements. E.g. 50,75,99.9")
+	method := fs.String("percentile-method", bucket.DefaultPercentileMethod,
+		"Compute percentiles with nearest-rank or linear interpolation.")
+	mean := fs.Bool("mean", false,
+		"Emit the mean of measurements as a .mean series.")
+	rate := fs.String("rate", "",
+		"Emit the per-second rate of counters also or only.")
+	bounds := fs.String("bounds", "",
+		"Comma separated upper bounds of histogram bins. E.g. 100,300,1000")
+	format := fs.String("format", "logfmt",
+		"Write metrics as logfmt or json.")
+	fs.Parse(args)
+	if *res < time.Second || *res%time.Second != 0 {
+		fmt.Fprintf(os.Stderr, "pipe: resolution must be whole seconds\n")
+		return 2
+	}
+	if *format != "logfmt" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "pipe: unknown format %q\n", *format)
+		return 2
+	}
+	opts := map[string][]string{
+		"resolution":        []string{strconv.Itoa(int(*res / time.Second))},
+		"percentile-method": []string{*method},
+		"mean":              []string{strconv.FormatBool(*mean)},
+		"rate":              []string{*rate},
+	}
+	if len(*prefix) > 0 {
+		opts["prefix"] = []string{*prefix}
+	}
+	if len(*percentiles) > 0 {
+		opts["percentiles"] = []string{*percentiles}
+	}
+	if len(*bounds) > 0 {
+		opts["bounds"] = []string{*bounds}
+	}
+	if err := parser.CheckOptions(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "pipe: %s\n", err)
+		return 2
+	}
+	p := pipe.New(cfg, opts, *format, os.Stdout)
+	p.Mchan = metchan.New(cfg)
+	if err := p.Run(os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "pipe: %s\n", err)
+		return 1
+	}
+	return 0
+}
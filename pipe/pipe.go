@@ -0,0 +1,107 @@
+// The pipe pkg aggregates log lines read from a stream and writes
+// the resulting metrics to another stream. It needs no drain, store
+// or Librato account, which makes it handy for checking instrumentation.
+//
+//	tail -f app.log | l2met pipe
+package pipe
+
+import (
+	"bufio"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/outlet"
+	"github.com/ryandotsmith/l2met/parser"
+	"github.com/ryandotsmith/l2met/store"
+	"io"
+	"sort"
+	"time"
+)
+
+type Pipe struct {
+	opts    map[string][]string
+	format  string
+	out     io.Writer
+	clock   clock.Clock
+	buckets map[bucket.Id]*bucket.Bucket
+	// Remembers the last of each running total.
+	totals *store.MemStore
+	Mchan  *metchan.Channel
+}
+
+// The opts are the same as the receiver's query parameters
+// (e.g. resolution & prefix). Metrics are written to out in
+// the given format, see outlet.WriteMetrics.
+func New(cfg *conf.D, opts map[string][]string, format string, out io.Writer) *Pipe {
+	p := new(Pipe)
+	p.opts = make(map[string][]string)
+	for k, v := range opts {
+		p.opts[k] = v
+	}
+	// The parser attributes buckets to a drain's auth.
+	p.opts["auth"] = []string{""}
+	p.format = format
+	p.out = out
+	p.clock = clock.Default(cfg.Clock)
+	p.buckets = make(map[bucket.Id]*bucket.Bucket)
+	p.totals = store.NewMemStore()
+	p.totals.Clock = p.clock
+	return p
+}
+
+// Reads lines from in until EOF. Each second, the buckets whose
+// interval has ended are written to out. At EOF the remaining
+// buckets are written regardless of their interval.
+func (p *Pipe) Run(in io.Reader) error {
+	ticker := p.clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	rdr := bufio.NewReader(in)
+	buckets := parser.BuildLineBuckets(rdr, p.opts, p.Mchan, p.clock.Now)
+	for {
+		select {
+		case b, ok := <-buckets:
+			if !ok {
+				return p.flush(time.Time{})
+			}
+			p.add(b)
+		case <-ticker.C:
+			if err := p.flush(p.clock.Now()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Pipe) add(b *bucket.Bucket) {
+	if b.Id.Type == "total" {
+		// The MemStore does not return errors.
+		store.Deltas(p.totals, []*bucket.Bucket{b})
+		if len(b.Vals) == 0 {
+			return
+		}
+	}
+	existing, ok := p.buckets[*b.Id]
+	if !ok {
+		existing = &bucket.Bucket{Id: b.Id}
+		p.buckets[*b.Id] = existing
+	}
+	existing.Merge(b)
+}
+
+// Writes the buckets that are ready at t. A zero t writes all buckets.
+func (p *Pipe) flush(t time.Time) error {
+	var ready []*bucket.Bucket
+	for k, b := range p.buckets {
+		if t.IsZero() || !b.Id.ReadyAt.After(t) {
+			ready = append(ready, b)
+			delete(p.buckets, k)
+		}
+	}
+	sort.Sort(bucket.ByTime(ready))
+	var metrics []*bucket.LibratoMetric
+	for _, b := range ready {
+		metrics = append(metrics, b.Metrics()...)
+	}
+	return outlet.WriteMetrics(p.out, p.format, metrics)
+}
@@ -0,0 +1,135 @@
+package pipe
+
+import (
+	"bytes"
+	"github.com/ryandotsmith/l2met/clock"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var pipeTest = []struct {
+	desc     string
+	in       string
+	format   string
+	expected string
+}{
+	{
+		"plain logfmt",
+		"measure#a=1 measure#a=3\ncount#c=2 source=web\n",
+		"logfmt",
+		"measure_time=1367928000 name=a count=2 sum=4 min=1 max=3\n" +
+			"measure_time=1367928000 name=a.median value=1\n" +
+			"measure_time=1367928000 name=a.perc95 value=3\n" +
+			"measure_time=1367928000 name=a.perc99 value=3\n" +
+			"measure_time=1367928000 name=a.stddev value=1\n" +
+			"measure_time=1367928000 name=a.variance value=1\n" +
+			"measure_time=1367928000 name=c source=web value=2\n",
+	},
+	{
+		"totals",
+		"total#r=100 source=web\ntotal#r=130 source=web\ntotal#r=10 source=web\n",
+		"logfmt",
+		"measure_time=1367928000 name=r source=web value=40\n",
+	},
+	{
+		"rfc5424",
+		"<190>1 2013-05-07T11:58:10+00:00 host app web.1 - sample#m=7MB\n",
+		"logfmt",
+		"measure_time=1367927880 name=m value=7 units=MB\n",
+	},
+	{
+		"units",
+		"measure#a=1ms measure#a=3ms\n",
+		"logfmt",
+		"measure_time=1367928000 name=a count=2 sum=4 min=1 max=3 units=ms\n" +
+			"measure_time=1367928000 name=a.median value=1 units=ms\n" +
+			"measure_time=1367928000 name=a.perc95 value=3 units=ms\n" +
+			"measure_time=1367928000 name=a.perc99 value=3 units=ms\n" +
+			"measure_time=1367928000 name=a.stddev value=1 units=ms\n" +
+			"measure_time=1367928000 name=a.variance value=1 units=ms^2\n",
+	},
+	{
+		"json",
+		"sample#m=7",
+		"json",
+		`{"name":"m","measure_time":1367928000,"value":7,"attributes":{"display_min":0,"display_units_long":""}}` + "\n",
+	},
+}
+
+func TestRun(t *testing.T) {
+	start := time.Date(2013, 5, 7, 12, 0, 0, 0, time.UTC)
+	for _, tt := range pipeTest {
+		cfg := &conf.D{Clock: clock.NewSim(start)}
+		out := new(bytes.Buffer)
+		p := New(cfg, nil, tt.format, out)
+		p.Mchan = new(metchan.Channel)
+		if err := p.Run(strings.NewReader(tt.in)); err != nil {
+			t.Fatalf("case=%s error=%s\n", tt.desc, err)
+		}
+		if out.String() != tt.expected {
+			t.Fatalf("case=%s actual=\n%s expected=\n%s\n", tt.desc, out, tt.expected)
+		}
+	}
+}
+
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.b.String()
+}
+
+// Buckets are written once their interval ends,
+// without waiting for the input to close.
+func TestRunInterval(t *testing.T) {
+	start := time.Date(2013, 5, 7, 12, 0, 0, 0, time.UTC)
+	sim := clock.NewSim(start)
+	out := new(syncBuffer)
+	p := New(&conf.D{Clock: sim}, map[string][]string{"resolution": []string{"10"}}, "logfmt", out)
+	p.Mchan = new(metchan.Channel)
+	in := &blockingReader{data: []byte("count#c=1\n"), done: make(chan struct{})}
+	defer close(in.done)
+	go p.Run(in)
+	for i := 0; i < 100; i++ {
+		sim.Add(time.Second)
+		time.Sleep(5 * time.Millisecond)
+		if strings.Contains(out.String(), "name=c") {
+			if sim.Now().Before(start.Add(10 * time.Second)) {
+				t.Fatalf("Bucket written before its interval ended. now=%s\n", sim.Now())
+			}
+			return
+		}
+	}
+	t.Fatalf("Expected bucket to be written by %s\n", sim.Now())
+}
+
+// Returns its data and then blocks like an open pipe.
+type blockingReader struct {
+	data []byte
+	done chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	<-r.done
+	return 0, io.EOF
+}
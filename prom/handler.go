@@ -0,0 +1,200 @@
+// The prom pkg accepts Prometheus remote_write requests
+// and places the samples into a receiver as l2met buckets.
+package prom
+
+import (
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/parser"
+	"github.com/ryandotsmith/l2met/receiver"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const nameLabel = "__name__"
+
+// Prometheus names counters with this suffix.
+const counterSuffix = "_total"
+
+type Handler struct {
+	recv *receiver.Receiver
+	// The values of these labels are joined to build the source.
+	// Can be overridden per request with ?source-labels=a,b
+	sourceLabels []string
+	// Limits the size of the body both before and after
+	// it has been decompressed.
+	maxBodySize int64
+	Mchan       *metchan.Channel
+}
+
+func NewHandler(cfg *conf.D, r *receiver.Receiver) *Handler {
+	h := new(Handler)
+	h.recv = r
+	h.sourceLabels = cfg.PromSourceLabels
+	h.maxBodySize = cfg.MaxBodySize
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer h.Mchan.Time("prom.accept", time.Now())
+	if req.Method != "POST" {
+		fmt.Printf("error=%q\n", "Non post method received.")
+		http.Error(w, "Invalid Request", 400)
+		return
+	}
+	tok, creds, err := auth.ParseRequest(req)
+	if err != nil {
+		fmt.Printf("error=%s\n", err)
+		http.Error(w, "Invalid Auth.", 400)
+		return
+	}
+	user := strings.Split(creds, ":")[0]
+	defer h.Mchan.CountReq(user)
+	if !h.recv.AdmitTenant(w, user) {
+		return
+	}
+	defer h.recv.ReleaseTenant(user)
+	// Remote write sets Content-Encoding: snappy. The body is
+	// a snappy block, which is decoded below rather than streamed.
+	if strings.EqualFold(req.Header.Get("Content-Encoding"), "snappy") {
+		req.Header.Del("Content-Encoding")
+	}
+	b, err := receiver.ReadBody(req, h.maxBodySize)
+	if err != nil {
+		fmt.Printf("error=%q\n", err)
+		http.Error(w, err.Error(), receiver.BodyErrorCode(err))
+		return
+	}
+	// Prometheus will not retry a 4xx, which is
+	// what we want for a payload we cannot decode.
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		fmt.Printf("at=prom-snappy error=%s\n", err)
+		http.Error(w, "Invalid snappy body.", 400)
+		return
+	}
+	if h.maxBodySize > 0 && int64(n) > h.maxBodySize {
+		err := receiver.ErrBodyTooLarge
+		fmt.Printf("at=prom-snappy error=%q\n", err)
+		http.Error(w, err.Error(), receiver.BodyErrorCode(err))
+		return
+	}
+	raw, err := snappy.Decode(nil, b)
+	if err != nil {
+		fmt.Printf("at=prom-snappy error=%s\n", err)
+		http.Error(w, "Invalid snappy body.", 400)
+		return
+	}
+	series, err := decodeWriteRequest(raw)
+	if err != nil {
+		fmt.Printf("at=prom-decode error=%s\n", err)
+		http.Error(w, "Invalid protobuf body.", 400)
+		return
+	}
+	opts := req.URL.Query()
+	for _, ts := range series {
+		for _, b := range h.buckets(ts, tok, opts) {
+			h.recv.ReceiveBucket(b)
+		}
+	}
+}
+
+// Each sample becomes a bucket of type sample. Remote write does not
+// tell us if a series is a counter or a gauge. Series named with the
+// counter suffix _total are taken as running totals, which are
+// converted to the increase since the previous sample.
+func (h *Handler) buckets(ts *timeSeries, tok string, opts url.Values) []*bucket.Bucket {
+	name, ok := ts.Labels[nameLabel]
+	if !ok {
+		h.Mchan.Measure("prom.missing-name", 1)
+		return nil
+	}
+	typ := "sample"
+	if strings.HasSuffix(name, counterSuffix) {
+		typ = "total"
+	}
+	res := parser.Resolution(opts)
+	keys := h.sourceKeys(opts)
+	src := source(ts.Labels, keys, opts)
+	name = parser.Prefix(opts, seriesName(name, ts.Labels, keys))
+	var buckets []*bucket.Bucket
+	for _, s := range ts.Samples {
+		// Stale markers are encoded as NaN.
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		id := new(bucket.Id)
+		id.Resolution = res
+		id.Time = time.Unix(0, s.Timestamp*int64(time.Millisecond)).Truncate(res)
+		id.ReadyAt = id.Time.Add(res)
+		id.Auth = tok
+		id.Name = name
+		id.Source = src
+		id.Type = typ
+		buckets = append(buckets, &bucket.Bucket{Id: id, Vals: []float64{s.Value}})
+	}
+	return buckets
+}
+
+func (h *Handler) sourceKeys(opts url.Values) []string {
+	if v := opts.Get("source-labels"); len(v) > 0 {
+		return strings.Split(v, ",")
+	}
+	return h.sourceLabels
+}
+
+func source(labels map[string]string, keys []string, opts url.Values) string {
+	var parts []string
+	for _, k := range keys {
+		if v, ok := labels[k]; ok && len(v) > 0 {
+			parts = append(parts, v)
+		}
+	}
+	return parser.SourcePrefix(opts, strings.Join(parts, "."))
+}
+
+// Labels other than the name and the source labels are folded into
+// the name, sorted by label name, so that series that differ by a
+// label are kept apart. E.g. http_requests_total{code="500"} becomes
+// http_requests_total.code_500
+func seriesName(name string, labels map[string]string, sourceKeys []string) string {
+	skip := map[string]bool{nameLabel: true}
+	for _, k := range sourceKeys {
+		skip[k] = true
+	}
+	var keys []string
+	for k, v := range labels {
+		// Labels starting with __ are internal to Prometheus.
+		if !skip[k] && !strings.HasPrefix(k, "__") && len(v) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	parts := []string{name}
+	for _, k := range keys {
+		parts = append(parts, k+"_"+sanitize(labels[k]))
+	}
+	return strings.Join(parts, ".")
+}
+
+// Librato names may contain letters, digits and .:-_
+// Other characters in label values are replaced with _
+func sanitize(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == ':' || r == '-' || r == '_':
+			return r
+		}
+		return '_'
+	}, v)
+}
@@ -0,0 +1,139 @@
+package prom
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/golang/snappy"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/receiver"
+	"github.com/ryandotsmith/l2met/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestHandler(t *testing.T, maxBodySize int64) (*Handler, *receiver.Receiver) {
+	cfg := &conf.D{
+		Concurrency:      1,
+		BufferSize:       10,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+		MaxBodySize:      maxBodySize,
+	}
+	r := receiver.NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	h := NewHandler(cfg, r)
+	h.Mchan = new(metchan.Channel)
+	return h, r
+}
+
+// Tokens are encrypted with a random nonce. Totals are kept per
+// token, so every request in a test must carry the same token.
+var authHeader string
+
+func post(t *testing.T, h *Handler, body []byte) *httptest.ResponseRecorder {
+	if len(authHeader) == 0 {
+		tok, err := auth.EncryptAndSign([]byte("u:p"))
+		if err != nil {
+			t.Fatalf("Must set $SECRETS error=%s\n", err)
+		}
+		authHeader = "Basic " + base64.URLEncoding.EncodeToString(append(tok, ':'))
+	}
+	req, _ := http.NewRequest("POST", "http://l2met.net/prom", bytes.NewReader(body))
+	req.Header.Set("Authorization", authHeader)
+	req.Header.Set("Content-Encoding", "snappy")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeHTTP(t *testing.T) {
+	h, r := newTestHandler(t, 1<<20)
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	var ts []byte
+	ts = append(ts, pbLabel("__name__", "queue_depth")...)
+	ts = append(ts, pbSample(7, ms)...)
+	w := post(t, h, snappy.Encode(nil, writeRequest(ts)))
+	if w.Code != 200 {
+		t.Fatalf("actual-code=%d expected-code=200 body=%s\n", w.Code, w.Body)
+	}
+	r.Stop()
+	buckets, err := r.Store.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var n int
+	for b := range buckets {
+		n++
+		if b.Id.Name != "queue_depth" || b.Last() != 7 {
+			t.Fatalf("actual=%s,%f expected=queue_depth,7\n", b.Id.Name, b.Last())
+		}
+	}
+	if n != 1 {
+		t.Fatalf("actual=%d expected=1\n", n)
+	}
+}
+
+func TestServeHTTPTooLarge(t *testing.T) {
+	h, r := newTestHandler(t, 1024)
+	defer r.Stop()
+	// Compresses to a few bytes but decodes past the limit.
+	raw := make([]byte, 1<<20)
+	w := post(t, h, snappy.Encode(nil, raw))
+	if w.Code != 413 {
+		t.Fatalf("actual-code=%d expected-code=413\n", w.Code)
+	}
+}
+
+func TestSeriesName(t *testing.T) {
+	labels := map[string]string{
+		"__name__": "http_requests_total",
+		"instance": "web.1",
+		"path":     "/users/{id}",
+		"code":     "500",
+	}
+	name := seriesName(labels["__name__"], labels, []string{"instance"})
+	if name != "http_requests_total.code_500.path__users__id_" {
+		t.Fatalf("actual=%s\n", name)
+	}
+}
+
+func TestServeHTTPCounters(t *testing.T) {
+	h, r := newTestHandler(t, 1<<20)
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	series := func(code string, v float64) []byte {
+		var ts []byte
+		ts = append(ts, pbLabel("__name__", "http_requests_total")...)
+		ts = append(ts, pbLabel("code", code)...)
+		return append(ts, pbSample(v, ms)...)
+	}
+	// The first write gives the starting totals.
+	writes := [][]byte{
+		writeRequest(series("200", 100), series("500", 7)),
+		writeRequest(series("200", 150), series("500", 9)),
+	}
+	for _, wr := range writes {
+		if w := post(t, h, snappy.Encode(nil, wr)); w.Code != 200 {
+			t.Fatalf("actual-code=%d expected-code=200\n", w.Code)
+		}
+	}
+	r.Stop()
+	buckets, err := r.Store.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	sums := make(map[string]float64)
+	for b := range buckets {
+		if b.Id.Type != "counter" {
+			t.Fatalf("actual-type=%s expected-type=counter\n", b.Id.Type)
+		}
+		sums[b.Id.Name] += b.Sum()
+	}
+	if sums["http_requests_total.code_200"] != 50 || sums["http_requests_total.code_500"] != 2 {
+		t.Fatalf("actual=%v\n", sums)
+	}
+}
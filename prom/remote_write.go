@@ -0,0 +1,226 @@
+package prom
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// The subset of the Prometheus remote_write protocol that we use.
+// See prometheus/prompb/types.proto & remote.proto.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// Unknown fields (e.g. metadata, exemplars, native histograms) are skipped.
+type timeSeries struct {
+	Labels  map[string]string
+	Samples []sample
+}
+
+type sample struct {
+	Value float64
+	// Milliseconds since the epoch.
+	Timestamp int64
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("prom: truncated protobuf message.")
+
+// A cursor over a protobuf encoded message.
+type pbuf struct {
+	b []byte
+	i int
+}
+
+func (p *pbuf) done() bool {
+	return p.i >= len(p.b)
+}
+
+func (p *pbuf) varint() (uint64, error) {
+	v, n := binary.Uvarint(p.b[p.i:])
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	p.i += n
+	return v, nil
+}
+
+func (p *pbuf) fixed64() (uint64, error) {
+	if len(p.b)-p.i < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(p.b[p.i:])
+	p.i += 8
+	return v, nil
+}
+
+func (p *pbuf) bytes() ([]byte, error) {
+	n, err := p.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(p.b)-p.i) < n {
+		return nil, errTruncated
+	}
+	b := p.b[p.i : p.i+int(n)]
+	p.i += int(n)
+	return b, nil
+}
+
+// Returns the field number and wire type of the next field.
+func (p *pbuf) key() (int, int, error) {
+	k, err := p.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(k >> 3), int(k & 7), nil
+}
+
+func (p *pbuf) skip(wire int) error {
+	var err error
+	switch wire {
+	case wireVarint:
+		_, err = p.varint()
+	case wireFixed64:
+		_, err = p.fixed64()
+	case wireBytes:
+		_, err = p.bytes()
+	case wireFixed32:
+		if len(p.b)-p.i < 4 {
+			return errTruncated
+		}
+		p.i += 4
+	default:
+		err = errors.New("prom: unsupported protobuf wire type.")
+	}
+	return err
+}
+
+// Decodes an uncompressed WriteRequest.
+func decodeWriteRequest(b []byte) ([]*timeSeries, error) {
+	var series []*timeSeries
+	p := &pbuf{b: b}
+	for !p.done() {
+		field, wire, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wire != wireBytes {
+			if err := p.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg, err := p.bytes()
+		if err != nil {
+			return nil, err
+		}
+		ts, err := decodeTimeSeries(msg)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, ts)
+	}
+	return series, nil
+}
+
+func decodeTimeSeries(b []byte) (*timeSeries, error) {
+	ts := &timeSeries{Labels: make(map[string]string)}
+	p := &pbuf{b: b}
+	for !p.done() {
+		field, wire, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		if wire != wireBytes || (field != 1 && field != 2) {
+			if err := p.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg, err := p.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if field == 1 {
+			name, val, err := decodeLabel(msg)
+			if err != nil {
+				return nil, err
+			}
+			ts.Labels[name] = val
+		} else {
+			s, err := decodeSample(msg)
+			if err != nil {
+				return nil, err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+	}
+	return ts, nil
+}
+
+func decodeLabel(b []byte) (string, string, error) {
+	var name, val string
+	p := &pbuf{b: b}
+	for !p.done() {
+		field, wire, err := p.key()
+		if err != nil {
+			return "", "", err
+		}
+		if wire != wireBytes || (field != 1 && field != 2) {
+			if err := p.skip(wire); err != nil {
+				return "", "", err
+			}
+			continue
+		}
+		s, err := p.bytes()
+		if err != nil {
+			return "", "", err
+		}
+		if field == 1 {
+			name = string(s)
+		} else {
+			val = string(s)
+		}
+	}
+	return name, val, nil
+}
+
+func decodeSample(b []byte) (sample, error) {
+	var s sample
+	p := &pbuf{b: b}
+	for !p.done() {
+		field, wire, err := p.key()
+		if err != nil {
+			return s, err
+		}
+		switch {
+		case field == 1 && wire == wireFixed64:
+			v, err := p.fixed64()
+			if err != nil {
+				return s, err
+			}
+			s.Value = math.Float64frombits(v)
+		case field == 2 && wire == wireVarint:
+			v, err := p.varint()
+			if err != nil {
+				return s, err
+			}
+			s.Timestamp = int64(v)
+		default:
+			if err := p.skip(wire); err != nil {
+				return s, err
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,96 @@
+package prom
+
+import (
+	"encoding/binary"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Helpers for hand encoding protobuf messages.
+func uvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(b, buf[:n]...)
+}
+
+func pbKey(field, wire int) []byte {
+	return uvarint(nil, uint64(field<<3|wire))
+}
+
+func pbBytes(field int, b []byte) []byte {
+	res := pbKey(field, wireBytes)
+	res = uvarint(res, uint64(len(b)))
+	return append(res, b...)
+}
+
+func pbLabel(name, val string) []byte {
+	b := pbBytes(1, []byte(name))
+	b = append(b, pbBytes(2, []byte(val))...)
+	return pbBytes(1, b)
+}
+
+func pbSample(v float64, ts int64) []byte {
+	b := pbKey(1, wireFixed64)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+	b = append(b, buf...)
+	b = append(b, pbKey(2, wireVarint)...)
+	b = uvarint(b, uint64(ts))
+	return pbBytes(2, b)
+}
+
+func writeRequest(series ...[]byte) []byte {
+	var b []byte
+	for _, s := range series {
+		b = append(b, pbBytes(1, s)...)
+	}
+	// Metadata (field 3) should be skipped.
+	return append(b, pbBytes(3, []byte("ignored"))...)
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	now := time.Now()
+	ms := now.UnixNano() / int64(time.Millisecond)
+	var ts []byte
+	ts = append(ts, pbLabel("__name__", "http_requests_total")...)
+	ts = append(ts, pbLabel("instance", "web.1")...)
+	ts = append(ts, pbSample(42.5, ms)...)
+	ts = append(ts, pbSample(math.NaN(), ms)...)
+
+	series, err := decodeWriteRequest(writeRequest(ts))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("expected=1 actual=%d\n", len(series))
+	}
+	if series[0].Labels["instance"] != "web.1" {
+		t.Errorf("actual-labels=%v\n", series[0].Labels)
+	}
+	if len(series[0].Samples) != 2 || series[0].Samples[0].Value != 42.5 {
+		t.Fatalf("actual-samples=%v\n", series[0].Samples)
+	}
+
+	h := &Handler{sourceLabels: []string{"instance"}}
+	opts := url.Values{"resolution": []string{"1"}, "prefix": []string{"app"}}
+	buckets := h.buckets(series[0], "tok", opts)
+	if len(buckets) != 1 {
+		t.Fatalf("expected=1 actual=%d\n", len(buckets))
+	}
+	id := buckets[0].Id
+	if id.Name != "app.http_requests_total" || id.Source != "web.1" {
+		t.Errorf("actual-name=%s actual-source=%s\n", id.Name, id.Source)
+	}
+	if id.Resolution != time.Second || !id.Time.Equal(now.Truncate(time.Second)) {
+		t.Errorf("actual-time=%s actual-res=%s\n", id.Time, id.Resolution)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	b := writeRequest(pbLabel("__name__", "x"))
+	if _, err := decodeWriteRequest(b[:len(b)-3]); err == nil {
+		t.Errorf("Expected error for truncated message.")
+	}
+}
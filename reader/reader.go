@@ -6,9 +6,11 @@ package reader
 import (
 	"fmt"
 	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
 	"github.com/ryandotsmith/l2met/conf"
 	"github.com/ryandotsmith/l2met/metchan"
 	"github.com/ryandotsmith/l2met/store"
+	"sync"
 	"time"
 )
 
@@ -19,6 +21,15 @@ type Reader struct {
 	Inbox        chan *bucket.Bucket
 	Outbox       chan *bucket.Bucket
 	Mchan        *metchan.Channel
+	// Estimates the store's time without a round trip.
+	StoreClock *store.Clock
+	// Drives the scan interval.
+	clock clock.Clock
+	// Counts buckets that have been read from the store
+	// but not yet marked Done by the consumer of the Outbox.
+	inFlight sync.WaitGroup
+	stop     chan struct{}
+	scanDone chan struct{}
 }
 
 // Sets the scan interval to 1s.
@@ -28,6 +39,10 @@ func New(cfg *conf.D, st store.Store) *Reader {
 	rdr.numOutlets = cfg.Concurrency
 	rdr.scanInterval = cfg.OutletInterval
 	rdr.str = st
+	rdr.StoreClock = store.NewClock(cfg, st)
+	rdr.clock = clock.Default(cfg.Clock)
+	rdr.stop = make(chan struct{})
+	rdr.scanDone = make(chan struct{})
 	return rdr
 }
 
@@ -39,15 +54,38 @@ func (r *Reader) Start(out chan *bucket.Bucket) {
 	}
 }
 
+// Stops scanning the store and waits for the buckets
+// already read to be marked Done by the consumer.
+func (r *Reader) Stop() {
+	close(r.stop)
+	<-r.scanDone
+	r.inFlight.Wait()
+}
+
+// The consumer of the Outbox must call Done for each
+// bucket once it has finished processing the bucket.
+func (r *Reader) Done() {
+	r.inFlight.Done()
+}
+
 func (r *Reader) scan() {
-	for _ = range time.Tick(r.scanInterval) {
+	defer close(r.scanDone)
+	ticker := r.clock.NewTicker(r.scanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
 		startScan := time.Now()
-		buckets, err := r.str.Scan(r.str.Now().Truncate(time.Second))
+		buckets, err := r.str.Scan(r.StoreClock.Now().Truncate(time.Second))
 		if err != nil {
 			fmt.Printf("at=bucket.scan error=%s\n", err)
 			continue
 		}
 		for b := range buckets {
+			r.inFlight.Add(1)
 			r.Inbox <- b
 		}
 		r.Mchan.Time("reader.scan", startScan)
@@ -0,0 +1,59 @@
+package receiver
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrInboxFull   = errors.New("Receiver inbox is full.")
+	ErrTenantLimit = errors.New("Too many requests in flight for tenant.")
+	ErrStopped     = errors.New("Receiver is shutting down.")
+	// Returned when the store could not be written, e.g. in
+	// sync-ack mode or when converting running totals.
+	ErrStoreUnavailable = errors.New("Unable to write to store.")
+	// Returned to a retry that arrives while the original
+	// request is still being handled.
+	ErrPending = errors.New("Request is being handled.")
+)
+
+// Limits the number of requests that a single tenant
+// can have in flight. This prevents a single drain from
+// consuming all of the receiver's inbox.
+type admission struct {
+	sync.Mutex
+	max int
+	m   map[string]int
+}
+
+// A max of 0 disables the limit.
+func newAdmission(max int) *admission {
+	return &admission{max: max, m: make(map[string]int)}
+}
+
+// Returns false if the tenant has reached its limit.
+// Each successful acquire must be followed by a release.
+func (a *admission) acquire(tenant string) bool {
+	if a.max <= 0 {
+		return true
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.m[tenant] >= a.max {
+		return false
+	}
+	a.m[tenant]++
+	return true
+}
+
+func (a *admission) release(tenant string) {
+	if a.max <= 0 {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.m[tenant]--
+	if a.m[tenant] <= 0 {
+		delete(a.m, tenant)
+	}
+}
@@ -0,0 +1,130 @@
+package receiver
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrBodyTooLarge        = errors.New("Request body too large.")
+	ErrUnsupportedEncoding = errors.New("Unsupported Content-Encoding.")
+)
+
+// A request body that is parsed as it is read. Reading more
+// than max bytes results in ErrBodyTooLarge. The first error
+// other than io.EOF is kept so that it can be reported after
+// the parser has stopped reading.
+type Body struct {
+	rdr     io.Reader
+	closers []io.Closer
+	n, max  int64
+	err     error
+}
+
+// A max of 0 disables the limit.
+func NewBody(rdr io.Reader, max int64) *Body {
+	return &Body{rdr: rdr, max: max}
+}
+
+// Opens the body of the request, decompressing it according
+// to the Content-Encoding header. Supports gzip and deflate.
+// The limit applies to the decompressed bytes. This protects us
+// from small requests that inflate to large bodies.
+func OpenBody(req *http.Request, max int64) (*Body, error) {
+	if max > 0 && req.ContentLength > max {
+		req.Body.Close()
+		return nil, ErrBodyTooLarge
+	}
+	rdr, err := decompress(req)
+	if err != nil {
+		req.Body.Close()
+		return nil, err
+	}
+	b := NewBody(rdr, max)
+	b.closers = []io.Closer{rdr, req.Body}
+	return b, nil
+}
+
+func (b *Body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.max > 0 && int64(len(p)) > b.max-b.n+1 {
+		p = p[:b.max-b.n+1]
+	}
+	n, err := b.rdr.Read(p)
+	b.n += int64(n)
+	if b.max > 0 && b.n > b.max {
+		n, err = 0, ErrBodyTooLarge
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Returns the first error encountered while reading.
+func (b *Body) Err() error {
+	return b.err
+}
+
+func (b *Body) Close() error {
+	for _, c := range b.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// Reads the entire body of the request.
+// See OpenBody for details on decompression and limits.
+func ReadBody(req *http.Request, max int64) ([]byte, error) {
+	b, err := OpenBody(req, max)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	return ioutil.ReadAll(b)
+}
+
+// Maps errors returned by OpenBody & ReadBody to an HTTP status code.
+func BodyErrorCode(err error) int {
+	switch err {
+	case ErrBodyTooLarge:
+		return 413
+	case ErrUnsupportedEncoding:
+		return 415
+	}
+	return 400
+}
+
+func decompress(req *http.Request) (io.ReadCloser, error) {
+	enc := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	switch enc {
+	case "", "identity":
+		return ioutil.NopCloser(req.Body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(req.Body)
+	case "deflate":
+		// RFC 2616 defines deflate as zlib wrapped data, however
+		// some clients send raw deflate. Peek at the header to decide.
+		br := bufio.NewReader(req.Body)
+		hdr, err := br.Peek(2)
+		if err == nil && isZlibHeader(hdr) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+func isZlibHeader(b []byte) bool {
+	cmf, flg := b[0], b[1]
+	return cmf&0x0f == 8 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
@@ -0,0 +1,84 @@
+package receiver
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+var body = []byte("88 <174>1 2013-07-22T00:06:26-00:00 somehost name test - measure#hello=1")
+
+func compress(enc string, b []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return b
+	}
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+var bodyTest = []struct {
+	enc    string
+	header string
+	max    int64
+	err    error
+}{
+	{"", "", 1024, nil},
+	{"gzip", "gzip", 1024, nil},
+	{"deflate", "deflate", 1024, nil},
+	{"raw-deflate", "deflate", 1024, nil},
+	{"gzip", "gzip", 10, ErrBodyTooLarge},
+	{"", "", 10, ErrBodyTooLarge},
+	{"gzip", "gzip", 0, nil},
+	{"", "br", 1024, ErrUnsupportedEncoding},
+}
+
+func TestReadBody(t *testing.T) {
+	for _, ts := range bodyTest {
+		in := bytes.NewReader(compress(ts.enc, body))
+		req, err := http.NewRequest("POST", "http://l2met.net/logs", in)
+		if err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+		if len(ts.header) > 0 {
+			req.Header.Set("Content-Encoding", ts.header)
+		}
+		actual, err := ReadBody(req, ts.max)
+		if err != ts.err {
+			t.Errorf("enc=%s actual-err=%v expected-err=%v\n",
+				ts.enc, err, ts.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(actual, body) {
+			t.Errorf("enc=%s actual=%q\n", ts.enc, actual)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	b := NewBody(bytes.NewReader(body), int64(len(body)-1))
+	if _, err := ioutil.ReadAll(b); err != ErrBodyTooLarge {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrBodyTooLarge)
+	}
+	if b.Err() != ErrBodyTooLarge {
+		t.Fatalf("actual-err=%v expected-err=%v\n", b.Err(), ErrBodyTooLarge)
+	}
+	b = NewBody(bytes.NewReader(body), int64(len(body)))
+	if _, err := ioutil.ReadAll(b); err != nil || b.Err() != nil {
+		t.Fatalf("error=%v\n", err)
+	}
+}
@@ -0,0 +1,87 @@
+package receiver
+
+import (
+	"errors"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/store"
+	"strings"
+	"time"
+)
+
+// Drains choose what happens to data that arrives after
+// the receiver deadline with ?late=drop|retime|accept
+const (
+	// Drop the data. This is the default.
+	LateDrop = "drop"
+	// Move the data into the current interval.
+	LateRetime = "retime"
+	// Keep the data in its original interval. The store
+	// will emit a corrected bucket for the interval.
+	LateAccept = "accept"
+)
+
+var ErrLatePolicy = errors.New("Unknown late policy.")
+
+// Reads the late option. Falls back to def when the option is
+// missing. Returns ErrLatePolicy along with def when the option
+// is not a known policy.
+func latePolicy(opts map[string][]string, def string) (string, error) {
+	v, present := opts["late"]
+	if !present || len(v) == 0 {
+		return def, nil
+	}
+	switch v[0] {
+	case LateDrop, LateRetime, LateAccept:
+		return v[0], nil
+	}
+	return def, ErrLatePolicy
+}
+
+// Applies the late policy to a bucket that is past the receiver
+// deadline. Returns the reason when the bucket should be dropped.
+func (r *Receiver) admitLate(b *bucket.Bucket, policy string, now time.Time) (string, bool) {
+	if b.Id.Delay(now) <= r.deadline {
+		return "", true
+	}
+	switch policy {
+	case LateRetime:
+		r.Mchan.Measure("receiver.late-retime", 1)
+		retime(b, now)
+		return "", true
+	case LateAccept:
+		// The store only keeps the values of an interval for
+		// so long. Past that, a correction would lose data.
+		if now.Sub(b.Id.ReadyAt) > store.Retention {
+			return "retention", false
+		}
+		r.Mchan.Measure("receiver.late-accept", 1)
+		return "", true
+	}
+	return "deadline", false
+}
+
+// Moves the bucket into the interval containing now.
+func retime(b *bucket.Bucket, now time.Time) {
+	id := *b.Id
+	d := id.Resolution
+	id.Time = time.Unix(0, int64((time.Duration(now.UnixNano())/d)*d))
+	id.ReadyAt = id.Time.Add(d).Truncate(d)
+	b.Id = &id
+}
+
+// Reports buckets that were not kept to the tenant.
+func (r *Receiver) drop(tok, reason string, n int) {
+	r.Mchan.Measure("receiver.drop", float64(n))
+	r.Mchan.CountDrop(userOf(tok), reason, n)
+}
+
+// Metchan reports per user, but buckets only carry the
+// encrypted credentials.
+func userOf(tok string) string {
+	creds, err := auth.Decrypt(tok)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.Split(creds, ":")[0]
+}
@@ -6,37 +6,33 @@ package receiver
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"github.com/ryandotsmith/l2met/auth"
 	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
 	"github.com/ryandotsmith/l2met/conf"
 	"github.com/ryandotsmith/l2met/metchan"
 	"github.com/ryandotsmith/l2met/parser"
 	"github.com/ryandotsmith/l2met/store"
-	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// We read the body of an http request and then close the request.
-// The processing of the body happens in a seperate routine. We use
-// this struct to hold the data that is passed inbetween routines.
+// The body of an http request is parsed in a seperate routine
+// as it is read. We use this struct to hold the data that is
+// passed inbetween routines.
 type LogRequest struct {
 	// The body of the HTTP request.
-	Body []byte
+	Body *Body
 	// Options from the query parameters
 	Opts map[string][]string
-}
-
-// The register accumulates buckets in memory.
-// A seperate routine working on an interval will flush
-// the buckets from the register.
-type register struct {
-	sync.Mutex
-	m map[bucket.Id]*bucket.Bucket
+	// If present, the result of parsing the body is sent here
+	// once the body has been consumed.
+	done chan error
 }
 
 type Receiver struct {
@@ -47,7 +43,7 @@ type Receiver struct {
 	// We put the data in the inbox to be processed.
 	Inbox chan *LogRequest
 	// The interval at which things are moved fron the inbox to the outbox
-	TransferTicker *time.Ticker
+	TransferTicker *clock.Ticker
 	// After we flush our register of buckets, we put the
 	// buckets in this channel to be flushed to redis.
 	Outbox chan *bucket.Bucket
@@ -57,33 +53,180 @@ type Receiver struct {
 	NumOutlets int
 	// Bucket storage.
 	Store store.Store
+	// Estimates the store's time without a round trip.
+	StoreClock *store.Clock
+	// Drives the transfer and report intervals.
+	clock clock.Clock
 	//Count the number of times we accept a bucket.
 	numBuckets, numReqs uint64
 	// The number of time units allowed to pass before dropping a
 	// log line.
 	deadline int64
+	// What to do with data past the deadline. Drains can override.
+	latePolicy string
+	// The max size of a request body after decompression.
+	maxBodySize int64
+	// Limits the number of in-flight requests per tenant.
+	tenants *admission
+	// Sent to rejected clients in the Retry-After header.
+	retryAfter time.Duration
+	// Withhold responses until buckets are written to the store.
+	syncAck bool
+	// Requests with the same value in one of these headers
+	// are considered retries and dropped within the window.
+	dedupHeaders []string
+	dedupWindow  time.Duration
+	// Limits on the memory held by the register. Once crossed,
+	// the largest buckets are spilled to the store early.
+	maxSeries, maxVals int
+	spilling           int32
 	// Publish receiver metrics on this channel.
 	Mchan    *metchan.Channel
 	inFlight sync.WaitGroup
+	// Guards the inbox and register from new data once
+	// the receiver has been stopped.
+	stopMut   sync.RWMutex
+	stopped   bool
+	accepting sync.WaitGroup
 }
 
 func NewReceiver(cfg *conf.D, s store.Store) *Receiver {
 	r := new(Receiver)
 	r.Inbox = make(chan *LogRequest, cfg.BufferSize)
 	r.Outbox = make(chan *bucket.Bucket, cfg.BufferSize)
-	r.Register = &register{m: make(map[bucket.Id]*bucket.Bucket)}
+	r.Register = newRegister(cfg.Concurrency)
 	r.FlushInterval = cfg.FlushInterval
 	r.NumOutlets = cfg.Concurrency
 	r.deadline = cfg.ReceiverDeadline
+	r.latePolicy = cfg.LatePolicy
+	if len(r.latePolicy) == 0 {
+		r.latePolicy = LateDrop
+	}
+	r.maxBodySize = cfg.MaxBodySize
+	r.tenants = newAdmission(cfg.TenantInFlight)
+	r.retryAfter = cfg.FlushInterval
+	r.dedupHeaders = []string{"Logplex-Frame-Id"}
+	if len(cfg.DedupHeader) > 0 {
+		r.dedupHeaders = append(r.dedupHeaders, cfg.DedupHeader)
+	}
+	r.dedupWindow = cfg.DedupWindow
+	r.syncAck = cfg.SyncAck
+	r.maxSeries = cfg.RegisterSeries
+	r.maxVals = cfg.RegisterVals
 	r.numBuckets = uint64(0)
 	r.numReqs = uint64(0)
 	r.Store = s
+	r.StoreClock = store.NewClock(cfg, s)
+	r.clock = clock.Default(cfg.Clock)
 	return r
 }
 
-func (r *Receiver) Receive(b []byte, opts map[string][]string) {
+// Queues the body to be parsed. Returns ErrInboxFull
+// instead of blocking when the inbox is at capacity.
+func (r *Receiver) Receive(b []byte, opts map[string][]string) error {
+	body := NewBody(bytes.NewReader(b), 0)
+	return r.enqueue(&LogRequest{Body: body, Opts: opts})
+}
+
+// Queues the body to be parsed and blocks until the body has
+// been consumed. The caller must not close the body until
+// ReceiveStream returns. If the body could not be read in its
+// entirety (e.g. ErrBodyTooLarge) none of its buckets are kept.
+// Returns ErrInboxFull without reading the body if the inbox
+// is at capacity.
+func (r *Receiver) ReceiveStream(body *Body, opts map[string][]string) error {
+	done := make(chan error, 1)
+	err := r.enqueue(&LogRequest{Body: body, Opts: opts, done: done})
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// When accept() falls behind we would rather have our clients
+// retry than pile up HTTP requests waiting on the inbox.
+func (r *Receiver) enqueue(req *LogRequest) error {
+	r.stopMut.RLock()
+	defer r.stopMut.RUnlock()
+	if r.stopped {
+		return ErrStopped
+	}
 	r.inFlight.Add(1)
-	r.Inbox <- &LogRequest{b, opts}
+	select {
+	case r.Inbox <- req:
+		return nil
+	default:
+		r.inFlight.Done()
+		return ErrInboxFull
+	}
+}
+
+// Removes the running totals from buckets and returns them.
+func takeTotals(buckets map[bucket.Id]*bucket.Bucket) []*bucket.Bucket {
+	var totals []*bucket.Bucket
+	for id, b := range buckets {
+		if b.Id.Type == "total" {
+			totals = append(totals, b)
+			delete(buckets, id)
+		}
+	}
+	return totals
+}
+
+// Totals are converted to counters once a request has been read
+// in its entirety, so that a rejected request does not move the
+// totals. Converted buckets with nothing to count are removed.
+// The caller adds the buckets to the register, which cannot fail,
+// so the totals are not advanced for data that is not kept.
+func (r *Receiver) totals(buckets map[bucket.Id]*bucket.Bucket) error {
+	totals := takeTotals(buckets)
+	if len(totals) == 0 {
+		return nil
+	}
+	if err := store.Deltas(r.Store, totals); err != nil {
+		r.Mchan.Printf("at=receiver-totals error=%s\n", err)
+		return ErrStoreUnavailable
+	}
+	for _, b := range totals {
+		if len(b.Vals) == 0 {
+			continue
+		}
+		if existing, ok := buckets[*b.Id]; ok {
+			existing.Merge(b)
+		} else {
+			buckets[*b.Id] = b
+		}
+	}
+	return nil
+}
+
+// Places a bucket directly into the register. This is used by
+// the ingest paths that do not require log parsing (e.g. statsd).
+// Buckets that have passed the deadline are subject to the
+// receiver's late policy. Returns false if the bucket was dropped.
+func (r *Receiver) ReceiveBucket(b *bucket.Bucket) bool {
+	r.stopMut.RLock()
+	defer r.stopMut.RUnlock()
+	if r.stopped {
+		r.drop(b.Id.Auth, "stopped", 1)
+		return false
+	}
+	if reason, ok := r.admitLate(b, r.latePolicy, r.StoreClock.Now()); !ok {
+		r.drop(b.Id.Auth, reason, 1)
+		return false
+	}
+	buckets := map[bucket.Id]*bucket.Bucket{*b.Id: b}
+	if err := r.totals(buckets); err != nil {
+		r.drop(b.Id.Auth, "store-unavailable", 1)
+		return false
+	}
+	if len(buckets) == 0 {
+		// E.g. the first total of a series.
+		return false
+	}
+	r.inFlight.Add(1)
+	r.addRegister(b)
+	return true
 }
 
 // Start moving data through the receiver's pipeline.
@@ -93,6 +236,7 @@ func (r *Receiver) Start() {
 	// it makes sense to parallelize this to the extent
 	// of the number of CPUs.
 	for i := 0; i < r.NumOutlets; i++ {
+		r.accepting.Add(1)
 		go r.accept()
 	}
 	// Outletting data to the store involves sending
@@ -102,11 +246,10 @@ func (r *Receiver) Start() {
 	for i := 0; i < r.NumOutlets; i++ {
 		go r.outlet()
 	}
-	r.TransferTicker = time.NewTicker(r.FlushInterval)
+	r.TransferTicker = r.clock.NewTicker(r.FlushInterval)
 	// The transfer is not a concurrent process.
 	// It removes buckets from the register to the outbox.
 	go r.scheduleTransfer()
-	go r.Report()
 }
 
 // This function can be used as
@@ -116,51 +259,171 @@ func (r *Receiver) Wait() {
 	r.inFlight.Wait()
 }
 
+// Stops accepting new data, parses the requests remaining
+// in the inbox, transfers the register to the outbox and
+// waits for the buckets to be written to the store.
+// Callers should stop sending HTTP requests to the receiver first.
+func (r *Receiver) Stop() {
+	r.stopMut.Lock()
+	if r.stopped {
+		r.stopMut.Unlock()
+		return
+	}
+	r.stopped = true
+	close(r.Inbox)
+	r.stopMut.Unlock()
+	r.accepting.Wait()
+	r.TransferTicker.Stop()
+	r.transfer()
+	r.Wait()
+}
+
 func (r *Receiver) accept() {
+	defer r.accepting.Done()
 	for req := range r.Inbox {
-		rdr := bufio.NewReader(bytes.NewReader(req.Body))
-		//TODO(ryandotsmith): Use a cached store time.
-		// The code to use here should look something like this:
-		// storeTime := r.Store.Now()
-		// However, since we are in a tight loop here,
-		// we cant make this call. Benchmarks show that using a local
-		// redis and making the time call on the redis store will slow
-		// down the receive loop by 10x.
-		// However, we run the risk of accepting data that is past
-		// its deadline due to clock drift on the localhost. Although
-		// we don't run the risk of re-reporting an interval to Librato
-		// because our outlet uses the store time to process buckets.
-		// So even if we write a bucket to redis that is past the
-		// deadline, our outlet scanner should not pick it up because
-		// it uses redis time to find buckets to process.
-		storeTime := time.Now()
 		startParse := time.Now()
-		for b := range parser.BuildBuckets(rdr, req.Opts, r.Mchan) {
-			if b.Id.Delay(storeTime) <= r.deadline {
-				r.inFlight.Add(1)
-				r.addRegister(b)
-			} else {
-				r.Mchan.Measure("receiver.drop", 1)
-			}
+		err := r.parse(req)
+		if req.done != nil {
+			req.done <- err
 		}
 		r.Mchan.Time("receiver.accept", startParse)
 		r.inFlight.Done()
 	}
 }
 
+// Buckets are aggregated per request and only added to the
+// register once the body has been read without error. Memory
+// held for a request is bounded by the size of its body.
+func (r *Receiver) parse(req *LogRequest) error {
+	rdr := bufio.NewReader(req.Body)
+	// Benchmarks show that making the time call on the redis
+	// store in this loop slows down the receive loop by 10x.
+	// The clock estimates the store's time from the local clock,
+	// so clock drift on the localhost will not cause us to
+	// accept data that is past its deadline.
+	storeTime := r.StoreClock.Now()
+	policy, _ := latePolicy(req.Opts, r.latePolicy)
+	buckets := make(map[bucket.Id]*bucket.Bucket)
+	// Drops are counted by the auth of the bucket and the reason.
+	drops := make(map[[2]string]int)
+	// The parser will stop once the body returns an error,
+	// so we always consume the entire channel.
+	for b := range parser.BuildBuckets(rdr, req.Opts, r.Mchan, r.StoreClock.Now) {
+		if reason, ok := r.admitLate(b, policy, storeTime); !ok {
+			drops[[2]string{b.Id.Auth, reason}]++
+			continue
+		}
+		if existing, ok := buckets[*b.Id]; ok {
+			existing.Merge(b)
+		} else {
+			buckets[*b.Id] = b
+		}
+	}
+	for k, n := range drops {
+		r.drop(k[0], k[1], n)
+	}
+	if err := req.Body.Err(); err != nil {
+		if err == ErrBodyTooLarge {
+			r.Mchan.Measure("receiver.body-too-large", 1)
+		}
+		return err
+	}
+	if r.syncAck || isSyncAck(req.Opts) {
+		// The totals are advanced last, in the same store update
+		// as their counters. A request that fails before then can
+		// be retried without losing the increase.
+		totals := takeTotals(buckets)
+		if err := r.putAll(buckets); err != nil {
+			return err
+		}
+		return r.putTotals(totals)
+	}
+	if err := r.totals(buckets); err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		r.inFlight.Add(1)
+		r.addRegister(b)
+	}
+	return nil
+}
+
+// Drains can opt-in to synchronous acknowledgement with ?sync-ack=true
+func isSyncAck(opts map[string][]string) bool {
+	v, present := opts["sync-ack"]
+	return present && len(v) > 0 && v[0] == "true"
+}
+
+// Bypasses the register and writes the buckets directly to
+// the store. The HTTP response is withheld until the buckets are
+// durable, so a client that does not receive a 200 can safely retry.
+// The store merges buckets, so we lose nothing by skipping the register.
+func (r *Receiver) putAll(buckets map[bucket.Id]*bucket.Bucket) error {
+	defer r.Mchan.Time("receiver.sync-put", time.Now())
+	for _, b := range buckets {
+		atomic.AddUint64(&r.numBuckets, 1)
+		if err := r.Store.Put(b, r.StoreClock.Now()); err != nil {
+			r.Mchan.Printf("at=receiver-sync-put error=%s\n", err)
+			return ErrStoreUnavailable
+		}
+	}
+	return nil
+}
+
+// Converts the totals and writes their counters to the store.
+// The totals are only kept if the counters are written.
+func (r *Receiver) putTotals(totals []*bucket.Bucket) error {
+	if len(totals) == 0 {
+		return nil
+	}
+	atomic.AddUint64(&r.numBuckets, uint64(len(totals)))
+	if err := store.PutDeltas(r.Store, totals, r.StoreClock.Now()); err != nil {
+		r.Mchan.Printf("at=receiver-sync-put error=%s\n", err)
+		return ErrStoreUnavailable
+	}
+	return nil
+}
+
 func (r *Receiver) addRegister(b *bucket.Bucket) {
-	r.Register.Lock()
-	defer r.Register.Unlock()
 	atomic.AddUint64(&r.numBuckets, 1)
-	k := *b.Id
-	_, present := r.Register.m[k]
-	if !present {
-		r.Mchan.Measure("receiver.add-bucket", 1)
-		r.Register.m[k] = b
-	} else {
+	if r.Register.add(b) {
 		r.Mchan.Measure("receiver.merge-bucket", 1)
-		r.Register.m[k].Merge(b)
+		// The bucket was merged into an existing bucket
+		// and will not pass through the outbox on its own.
+		r.inFlight.Done()
+	} else {
+		r.Mchan.Measure("receiver.add-bucket", 1)
+	}
+	if r.Register.over(r.maxSeries, r.maxVals) {
+		r.spill()
+	}
+}
+
+// Moves the largest buckets to the outbox ahead of the next transfer.
+// We spill below the limits so that every add does not trigger a spill.
+// Only one routine spills at a time, the others carry on accepting.
+// The store merges buckets, so a series that is spilled and then
+// receives more data in the same interval is still reported once.
+func (r *Receiver) spill() {
+	if !atomic.CompareAndSwapInt32(&r.spilling, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&r.spilling, 0)
+	defer r.Mchan.Time("receiver.spill", time.Now())
+	buckets := r.Register.evict(lowWater(r.maxSeries), lowWater(r.maxVals))
+	r.Mchan.Measure("receiver.spill-bucket", float64(len(buckets)))
+	for _, b := range buckets {
+		r.Outbox <- b
+	}
+}
+
+// The level a limit is spilled down to: a tenth below the limit
+// and at least one below it. Returns -1 for a disabled limit.
+func lowWater(max int) int {
+	if max <= 0 {
+		return -1
 	}
+	return max - (max+9)/10
 }
 
 func (r *Receiver) scheduleTransfer() {
@@ -170,12 +433,9 @@ func (r *Receiver) scheduleTransfer() {
 }
 
 func (r *Receiver) transfer() {
-	r.Register.Lock()
-	defer r.Register.Unlock()
-	for k := range r.Register.m {
-		if m, ok := r.Register.m[k]; ok {
-			delete(r.Register.m, k)
-			r.Outbox <- m
+	for i := range r.Register.shards {
+		for _, b := range r.Register.swap(i) {
+			r.Outbox <- b
 		}
 	}
 }
@@ -183,8 +443,8 @@ func (r *Receiver) transfer() {
 func (r *Receiver) outlet() {
 	for b := range r.Outbox {
 		startPut := time.Now()
-		if err := r.Store.Put(b); err != nil {
-			fmt.Printf("error=%s\n", err)
+		if err := r.Store.Put(b, r.StoreClock.Now()); err != nil {
+			r.Mchan.Printf("error=%s\n", err)
 		}
 		r.Mchan.Time("receiver.outlet", startPut)
 		r.inFlight.Done()
@@ -195,7 +455,7 @@ func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	atomic.AddUint64(&r.numReqs, 1)
 	defer r.Mchan.Time("http.accept", time.Now())
 	if req.Method != "POST" {
-		fmt.Printf("error=%q\n", "Non post method received.")
+		r.Mchan.Printf("error=%q\n", "Non post method received.")
 		http.Error(w, "Invalid Request", 400)
 		return
 	}
@@ -204,49 +464,177 @@ func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// for our receiver. Later, another routine
 	// can extract the username and password from
 	// the auth to use it against the Librato API.
-	authLine, ok := req.Header["Authorization"]
-	if !ok && len(authLine) > 0 {
-		fmt.Printf("error=%q\n", "Missing authorization header.")
-		http.Error(w, "Missing Auth.", 400)
+	parseRes, creds, err := auth.ParseRequest(req)
+	if err != nil {
+		r.Mchan.Printf("error=%s\n", err)
+		http.Error(w, "Invalid Auth.", 400)
 		return
 	}
-	parseRes, err := auth.Parse(authLine[0])
-	if err != nil {
-		fmt.Printf("error=%s\n", err)
-		http.Error(w, "Fail: Parse auth.", 400)
+	user := strings.Split(creds, ":")[0]
+	defer r.Mchan.CountReq(user)
+	if !r.AdmitTenant(w, user) {
 		return
 	}
-	var creds string
-	if creds, err = auth.Decrypt(parseRes); err != nil {
-		fmt.Printf("error=%s\n", err)
-		http.Error(w, "Invalid Request", 400)
+	defer r.ReleaseTenant(user)
+	key, state := r.claim(req, user)
+	switch state {
+	case store.Committed:
+		// We have already accepted this request. Respond with
+		// a 200 so that the client stops retrying.
+		r.Mchan.Measure("receiver.duplicate", 1)
+		req.Body.Close()
+		return
+	case store.Pending:
+		// The request is still being handled and may yet fail.
+		// The client retries until it is accepted or rejected.
+		req.Body.Close()
+		r.reject(w, user, "pending", ErrPending, 503)
 		return
 	}
-	defer r.Mchan.CountReq(strings.Split(creds, ":")[0])
 	v := req.URL.Query()
 	v.Add("auth", parseRes)
-	b, err := ioutil.ReadAll(req.Body)
-	req.Body.Close()
+	if _, err := latePolicy(v, r.latePolicy); err != nil {
+		r.release(key)
+		r.Mchan.Printf("error=%q\n", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := parser.CheckOptions(v); err != nil {
+		r.release(key)
+		r.Mchan.Printf("error=%q\n", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	body, err := OpenBody(req, r.maxBodySize)
 	if err != nil {
-		fmt.Printf("error=%q\n", "Unable to read request body.")
-		http.Error(w, "Invalid Request", 400)
+		r.release(key)
+		r.Mchan.Printf("error=%q\n", err)
+		http.Error(w, err.Error(), BodyErrorCode(err))
 		return
 	}
-	r.Receive(b, v)
+	defer body.Close()
+	err = r.ReceiveStream(body, v)
+	if err != nil {
+		// The client will retry and we want to accept the retry.
+		r.release(key)
+	} else {
+		r.commit(key)
+	}
+	switch err {
+	case nil:
+	case ErrInboxFull:
+		r.reject(w, user, "inbox-full", err, 503)
+	case ErrStopped:
+		r.reject(w, user, "stopped", err, 503)
+	case ErrStoreUnavailable:
+		r.reject(w, user, "store-unavailable", err, 503)
+	default:
+		r.Mchan.Printf("error=%q\n", err)
+		http.Error(w, err.Error(), BodyErrorCode(err))
+	}
+}
+
+// Limits the number of requests a tenant has in flight across
+// the ingest endpoints. Responds with a 429 and returns false if
+// the tenant is at its limit. Otherwise ReleaseTenant must be
+// called once the request has been handled.
+func (r *Receiver) AdmitTenant(w http.ResponseWriter, user string) bool {
+	if !r.tenants.acquire(user) {
+		r.reject(w, user, "tenant-limit", ErrTenantLimit, 429)
+		return false
+	}
+	return true
+}
+
+func (r *Receiver) ReleaseTenant(user string) {
+	r.tenants.release(user)
+}
+
+// Bounds how long a claim stays pending. Requests are
+// expected to be handled well within this time.
+const maxPendingClaim = time.Minute
+
+// Logplex retries a post when it times out, even if we have
+// processed the body. The frame id lets us recognize the retry.
+// The claim is made in the store so that retries landing on
+// other receivers are recognized too. The claim is pending until
+// the request is accepted, which commits it, or rejected, which
+// releases it. A non-empty key must be committed or released.
+func (r *Receiver) claim(req *http.Request, user string) (string, store.ClaimState) {
+	if r.dedupWindow <= 0 {
+		return "", store.Claimed
+	}
+	for _, h := range r.dedupHeaders {
+		id := req.Header.Get(h)
+		if len(id) == 0 {
+			continue
+		}
+		key := user + "." + id
+		// A receiver that dies while handling the request
+		// leaves the claim pending until it expires.
+		ttl := r.dedupWindow
+		if ttl > maxPendingClaim {
+			ttl = maxPendingClaim
+		}
+		state, err := r.Store.Claim(key, ttl)
+		if err != nil {
+			// We would rather double count than drop data.
+			r.Mchan.Printf("at=receiver-claim error=%s\n", err)
+			return "", store.Claimed
+		}
+		return key, state
+	}
+	return "", store.Claimed
+}
+
+// If the commit fails, the pending claim expires and
+// a retry of the request would be counted again.
+func (r *Receiver) commit(key string) {
+	if len(key) == 0 {
+		return
+	}
+	if err := r.Store.Commit(key, r.dedupWindow); err != nil {
+		r.Mchan.Printf("at=receiver-commit error=%s\n", err)
+	}
+}
+
+func (r *Receiver) release(key string) {
+	if len(key) == 0 {
+		return
+	}
+	if err := r.Store.Release(key); err != nil {
+		r.Mchan.Printf("at=receiver-release error=%s\n", err)
+	}
+}
+
+// Logplex and log-shuttle will retry requests that fail with a 5xx.
+// The Retry-After header gives the receiver a flush interval to catch up.
+func (r *Receiver) reject(w http.ResponseWriter, user, reason string, err error, code int) {
+	r.Mchan.Printf("error=%q user=%s\n", err, user)
+	r.Mchan.CountReject(user, reason)
+	secs := int(math.Ceil(r.retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, err.Error(), code)
 }
 
 // Keep an eye on the lenghts of our bufferes.
 // If they are maxed out, something is going wrong.
+// Prints every second, so it is not started by Start.
 func (r *Receiver) Report() {
-	for _ = range time.Tick(time.Second) {
+	for _ = range r.clock.NewTicker(time.Second).C {
 		nb := atomic.LoadUint64(&r.numBuckets)
 		nr := atomic.LoadUint64(&r.numReqs)
 		atomic.AddUint64(&r.numBuckets, -nb)
 		atomic.AddUint64(&r.numReqs, -nr)
-		fmt.Printf("receiver.http.num-buckets=%d\n", nb)
-		fmt.Printf("receiver.http.num-reqs=%d\n", nr)
+		r.Mchan.Printf("receiver.http.num-buckets=%d\n", nb)
+		r.Mchan.Printf("receiver.http.num-reqs=%d\n", nr)
 		pre := "receiver.buffer."
 		r.Mchan.Measure(pre+"inbox", float64(len(r.Inbox)))
 		r.Mchan.Measure(pre+"outbox", float64(len(r.Outbox)))
+		r.Mchan.Measure("receiver.register.series", float64(r.Register.len()))
+		r.Mchan.Measure("receiver.register.values", float64(r.Register.numVals()))
 	}
 }
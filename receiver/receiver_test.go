@@ -0,0 +1,602 @@
+package receiver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestReceiver() *Receiver {
+	cfg := &conf.D{
+		Concurrency:      2,
+		BufferSize:       10,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+	}
+	r := NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	return r
+}
+
+func logLines(n int) string {
+	ts := time.Now().UTC().Format("2006-01-02T15:04:05+00:00")
+	var lines []string
+	for i := 0; i < n; i++ {
+		packet := fmt.Sprintf("<190>1 %s hostname app web - measure#a=%d", ts, i)
+		lines = append(lines, fmt.Sprintf("%d %s", len(packet), packet))
+	}
+	return strings.Join(lines, "")
+}
+
+func TestReceiveStream(t *testing.T) {
+	r := newTestReceiver()
+	opts := map[string][]string{"auth": []string{"abc123"}}
+	in := logLines(10)
+	body := NewBody(strings.NewReader(in), int64(len(in)))
+	if err := r.ReceiveStream(body, opts); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if r.Register.len() != 1 {
+		t.Fatalf("expected=1 actual=%d\n", r.Register.len())
+	}
+	for i := range r.Register.shards {
+		for _, b := range r.Register.swap(i) {
+			if b.Count() != 10 {
+				t.Fatalf("expected=10 actual=%d\n", b.Count())
+			}
+		}
+	}
+}
+
+func TestReceiveStreamTooLarge(t *testing.T) {
+	r := newTestReceiver()
+	opts := map[string][]string{"auth": []string{"abc123"}}
+	in := logLines(10)
+	body := NewBody(strings.NewReader(in), int64(len(in)/2))
+	if err := r.ReceiveStream(body, opts); err != ErrBodyTooLarge {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrBodyTooLarge)
+	}
+	if r.Register.len() != 0 {
+		t.Fatalf("expected=0 actual=%d\n", r.Register.len())
+	}
+}
+
+func TestReceiveInboxFull(t *testing.T) {
+	cfg := &conf.D{BufferSize: 1, FlushInterval: time.Hour}
+	r := NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	// Without starting the receiver nothing drains the inbox.
+	if err := r.Receive([]byte(logLines(1)), nil); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if err := r.Receive([]byte(logLines(1)), nil); err != ErrInboxFull {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrInboxFull)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(1)
+	if !a.acquire("a") {
+		t.Fatalf("Expected first acquire to succeed.")
+	}
+	if a.acquire("a") {
+		t.Fatalf("Expected second acquire to fail.")
+	}
+	if !a.acquire("b") {
+		t.Fatalf("Expected other tenant to be admitted.")
+	}
+	a.release("a")
+	if !a.acquire("a") {
+		t.Fatalf("Expected acquire after release to succeed.")
+	}
+}
+
+func TestClaim(t *testing.T) {
+	cfg := &conf.D{BufferSize: 1, DedupWindow: time.Minute}
+	r := NewReceiver(cfg, store.NewMemStore())
+	req, _ := http.NewRequest("POST", "http://l2met.net/logs", nil)
+	if _, state := r.claim(req, "u"); state != store.Claimed {
+		t.Fatalf("Expected request without frame id to be accepted.")
+	}
+	req.Header.Set("Logplex-Frame-Id", "abc")
+	key, state := r.claim(req, "u")
+	if state != store.Claimed {
+		t.Fatalf("Expected first request to be accepted.")
+	}
+	if _, state := r.claim(req, "u"); state != store.Pending {
+		t.Fatalf("actual=%d expected=pending\n", state)
+	}
+	if _, state := r.claim(req, "other"); state != store.Claimed {
+		t.Fatalf("Expected other tenant to be accepted.")
+	}
+	r.release(key)
+	key, state = r.claim(req, "u")
+	if state != store.Claimed {
+		t.Fatalf("Expected request to be accepted after release.")
+	}
+	r.commit(key)
+	if _, state := r.claim(req, "u"); state != store.Committed {
+		t.Fatalf("actual=%d expected=committed\n", state)
+	}
+}
+
+func TestReceiveStreamSyncAck(t *testing.T) {
+	r := newTestReceiver()
+	opts := map[string][]string{
+		"auth":     []string{"abc123"},
+		"sync-ack": []string{"true"},
+	}
+	in := logLines(3)
+	if err := r.ReceiveStream(NewBody(strings.NewReader(in), 0), opts); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if r.Register.len() != 0 {
+		t.Fatalf("Expected register to be bypassed. actual=%d\n", r.Register.len())
+	}
+	buckets, err := r.Store.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var n int
+	for b := range buckets {
+		n += b.Count()
+	}
+	if n != 3 {
+		t.Fatalf("expected=3 actual=%d\n", n)
+	}
+}
+
+func TestStop(t *testing.T) {
+	r := newTestReceiver()
+	opts := map[string][]string{"auth": []string{"abc123"}}
+	if err := r.Receive([]byte(logLines(5)), opts); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	// The flush interval is an hour so only Stop
+	// can move the buckets into the store.
+	r.Stop()
+	buckets, err := r.Store.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var n int
+	for b := range buckets {
+		n += b.Count()
+	}
+	if n != 5 {
+		t.Fatalf("expected=5 actual=%d\n", n)
+	}
+	if err := r.Receive([]byte(logLines(1)), opts); err != ErrStopped {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrStopped)
+	}
+}
+
+func TestRegisterMerge(t *testing.T) {
+	reg := newRegister(4)
+	ts := time.Now().Truncate(time.Minute)
+	for i := 0; i < 8; i++ {
+		id := &bucket.Id{Name: "a", Auth: "x", Time: ts, Resolution: time.Minute}
+		merged := reg.add(&bucket.Bucket{Id: id, Vals: []float64{1}})
+		if merged != (i > 0) {
+			t.Fatalf("i=%d actual=%t expected=%t\n", i, merged, i > 0)
+		}
+	}
+	id := &bucket.Id{Name: "b", Auth: "x", Time: ts, Resolution: time.Minute}
+	reg.add(&bucket.Bucket{Id: id, Vals: []float64{1}})
+	if reg.len() != 2 {
+		t.Fatalf("actual=%d expected=2\n", reg.len())
+	}
+	var n int
+	for i := range reg.shards {
+		for _, b := range reg.swap(i) {
+			n += b.Count()
+		}
+	}
+	if n != 9 || reg.len() != 0 {
+		t.Fatalf("actual=%d len=%d expected=9 len=0\n", n, reg.len())
+	}
+}
+
+func TestRegisterEvict(t *testing.T) {
+	reg := newRegister(2)
+	ts := time.Now().Truncate(time.Minute)
+	for _, n := range []int{1, 5, 3} {
+		id := &bucket.Id{Name: fmt.Sprintf("b%d", n), Time: ts, Resolution: time.Minute}
+		reg.add(&bucket.Bucket{Id: id, Vals: make([]float64, n)})
+	}
+	if !reg.over(0, 8) {
+		t.Fatalf("Expected 9 values to be over the limit of 8.")
+	}
+	evicted := reg.evict(-1, 4)
+	if len(evicted) != 1 || len(evicted[0].Vals) != 5 {
+		t.Fatalf("actual=%d expected=1 bucket with 5 values\n", len(evicted))
+	}
+	if reg.len() != 2 || reg.numVals() != 4 {
+		t.Fatalf("actual=%d,%d expected=2,4\n", reg.len(), reg.numVals())
+	}
+}
+
+func TestReceiveBucketSpill(t *testing.T) {
+	cfg := &conf.D{
+		Concurrency:      2,
+		BufferSize:       10,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+		RegisterSeries:   1,
+	}
+	r := NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	ts := time.Now().Truncate(time.Minute)
+	for _, name := range []string{"a", "b"} {
+		id := &bucket.Id{Name: name, Time: ts, Resolution: time.Minute}
+		r.ReceiveBucket(&bucket.Bucket{Id: id, Vals: []float64{1}})
+	}
+	// With a limit of 1 the register spills down to 0.
+	if r.Register.len() != 0 {
+		t.Fatalf("actual=%d expected=0\n", r.Register.len())
+	}
+	r.Stop()
+	buckets, err := r.Store.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var n int
+	for _ = range buckets {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("actual=%d expected=2\n", n)
+	}
+}
+
+var lowWaterTest = []struct {
+	max, low int
+}{
+	{0, -1},
+	{1, 0},
+	{5, 4},
+	{10, 9},
+	{1000, 900},
+}
+
+func TestLowWater(t *testing.T) {
+	for _, ts := range lowWaterTest {
+		if low := lowWater(ts.max); low != ts.low {
+			t.Fatalf("max=%d actual=%d expected=%d\n", ts.max, low, ts.low)
+		}
+	}
+}
+
+func TestRegisterSize(t *testing.T) {
+	reg := newRegister(1)
+	id := &bucket.Id{Name: "users", Type: "unique", Time: time.Now().Truncate(time.Minute)}
+	for i := 0; i < 2000; i++ {
+		b := &bucket.Bucket{Id: id}
+		b.AddUnique([]byte(fmt.Sprintf("user-%d", i)))
+		reg.add(b)
+	}
+	// The HLL's registers are counted rather than its one bucket.
+	if n := reg.numVals(); n != 1<<bucket.HLLPrecision/8 {
+		t.Fatalf("actual=%d expected=%d\n", n, 1<<bucket.HLLPrecision/8)
+	}
+	reg.evict(-1, 0)
+	if reg.len() != 0 || reg.numVals() != 0 {
+		t.Fatalf("actual=%d,%d expected=0,0\n", reg.len(), reg.numVals())
+	}
+}
+
+var lateTest = []struct {
+	policy string
+	age    time.Duration
+	kept   bool
+	reason string
+}{
+	{LateDrop, time.Minute, true, ""},
+	{LateDrop, 4 * time.Minute, false, "deadline"},
+	{LateRetime, 4 * time.Minute, true, ""},
+	{LateAccept, 4 * time.Minute, true, ""},
+	{LateAccept, 10 * time.Minute, false, "retention"},
+}
+
+func TestAdmitLate(t *testing.T) {
+	r := newTestReceiver()
+	now := time.Now()
+	for _, tt := range lateTest {
+		ts := now.Add(-tt.age).Truncate(time.Minute)
+		id := &bucket.Id{Time: ts, ReadyAt: ts.Add(time.Minute), Resolution: time.Minute}
+		b := &bucket.Bucket{Id: id}
+		reason, kept := r.admitLate(b, tt.policy, now)
+		if kept != tt.kept || reason != tt.reason {
+			t.Fatalf("policy=%s actual=%t,%q expected=%t,%q\n",
+				tt.policy, kept, reason, tt.kept, tt.reason)
+		}
+		if tt.policy == LateRetime && !b.Id.Time.Equal(now.Truncate(time.Minute)) {
+			t.Fatalf("Expected bucket to be moved into the current interval.")
+		}
+	}
+}
+
+// Bodies queued without options have no auth to attribute drops to.
+func TestReceiveStreamLateWithoutOpts(t *testing.T) {
+	r := newTestReceiver()
+	ts := time.Now().Add(-10 * time.Minute).UTC().Format("2006-01-02T15:04:05+00:00")
+	packet := fmt.Sprintf("<190>1 %s hostname app web - measure#a=1", ts)
+	in := fmt.Sprintf("%d %s", len(packet), packet) + logLines(1)
+	if err := r.ReceiveStream(NewBody(strings.NewReader(in), 0), nil); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if n := r.Register.len(); n != 1 {
+		t.Fatalf("actual=%d expected=1\n", n)
+	}
+}
+
+func TestLatePolicyOption(t *testing.T) {
+	opts := map[string][]string{"late": []string{"accept"}}
+	if p, err := latePolicy(opts, LateDrop); p != LateAccept || err != nil {
+		t.Fatalf("actual=%s,%v expected=%s\n", p, err, LateAccept)
+	}
+	opts["late"] = []string{"later"}
+	if _, err := latePolicy(opts, LateDrop); err != ErrLatePolicy {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrLatePolicy)
+	}
+	if p, _ := latePolicy(nil, LateRetime); p != LateRetime {
+		t.Fatalf("actual=%s expected=%s\n", p, LateRetime)
+	}
+}
+
+func totalLines(totals ...int) string {
+	ts := time.Now().UTC().Format("2006-01-02T15:04:05+00:00")
+	var in string
+	for _, total := range totals {
+		packet := fmt.Sprintf("<190>1 %s hostname app web - total#reqs=%d", ts, total)
+		in += fmt.Sprintf("%d %s", len(packet), packet)
+	}
+	return in
+}
+
+// Receives each body as a request and returns the counted increase.
+func receiveTotals(t *testing.T, r *Receiver, max int64, bodies ...string) float64 {
+	opts := map[string][]string{"auth": []string{"abc123"}}
+	for _, in := range bodies {
+		r.ReceiveStream(NewBody(strings.NewReader(in), max), opts)
+	}
+	var sum float64
+	for i := range r.Register.shards {
+		for _, b := range r.Register.swap(i) {
+			if b.Id.Type != "counter" {
+				t.Fatalf("actual-type=%s expected-type=counter\n", b.Id.Type)
+			}
+			sum += b.Sum()
+		}
+	}
+	return sum
+}
+
+func TestReceiveTotals(t *testing.T) {
+	r := newTestReceiver()
+	if sum := receiveTotals(t, r, 0, totalLines(100, 120, 150)); sum != 50 {
+		t.Fatalf("actual=%f expected=50\n", sum)
+	}
+}
+
+func TestReceiveTotalsRejected(t *testing.T) {
+	r := newTestReceiver()
+	last := totalLines(1100)
+	// The second body is too large. Its totals must not be
+	// kept, or the increase up to 1097 is never counted.
+	sum := receiveTotals(t, r, int64(len(last)), totalLines(100), totalLines(500, 1097), last)
+	if sum != 1000 {
+		t.Fatalf("actual=%f expected=1000\n", sum)
+	}
+}
+
+func TestReceiveTotalsOutOfOrder(t *testing.T) {
+	r := newTestReceiver()
+	sum := receiveTotals(t, r, 0, totalLines(100000), totalLines(100020),
+		totalLines(100010), totalLines(100030))
+	if sum != 30 {
+		t.Fatalf("actual=%f expected=30\n", sum)
+	}
+}
+
+// A store whose writes fail until the test lets them through.
+type flakyStore struct {
+	*store.MemStore
+	failPuts, failTotals int
+}
+
+func (s *flakyStore) Put(b *bucket.Bucket, now time.Time) error {
+	if s.failPuts > 0 {
+		s.failPuts--
+		return errors.New("down")
+	}
+	return s.MemStore.Put(b, now)
+}
+
+func (s *flakyStore) UpdateTotals(keys []string, ttl time.Duration, now time.Time, next func([]float64, []bool) ([]float64, []*bucket.Bucket)) error {
+	if s.failTotals > 0 {
+		s.failTotals--
+		return errors.New("down")
+	}
+	return s.MemStore.UpdateTotals(keys, ttl, now, next)
+}
+
+// A sync-ack request that fails is retried by the client.
+// The retry must count the increase the failed request did not.
+func TestReceiveTotalsSyncAckRetry(t *testing.T) {
+	cfg := &conf.D{Concurrency: 1, BufferSize: 10, FlushInterval: time.Hour, ReceiverDeadline: 2, SyncAck: true}
+	st := &flakyStore{MemStore: store.NewMemStore()}
+	r := NewReceiver(cfg, st)
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	opts := map[string][]string{"auth": []string{"abc123"}}
+	receive := func(in string) error {
+		return r.ReceiveStream(NewBody(strings.NewReader(in), 0), opts)
+	}
+	if err := receive(totalLines(100)); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	in := logLines(1) + totalLines(150)
+	st.failPuts = 1
+	if err := receive(in); err != ErrStoreUnavailable {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrStoreUnavailable)
+	}
+	st.failTotals = 1
+	if err := receive(in); err != ErrStoreUnavailable {
+		t.Fatalf("actual-err=%v expected-err=%v\n", err, ErrStoreUnavailable)
+	}
+	if err := receive(in); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	buckets, err := st.Scan(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var sum float64
+	for b := range buckets {
+		if b.Id.Type == "counter" {
+			sum += b.Sum()
+		}
+	}
+	if sum != 50 {
+		t.Fatalf("actual=%f expected=50\n", sum)
+	}
+}
+
+func postLogs(t *testing.T, r *Receiver, body string, hdr map[string]string) *httptest.ResponseRecorder {
+	tok, err := auth.EncryptAndSign([]byte("u:p"))
+	if err != nil {
+		t.Fatalf("Must set $SECRETS error=%s\n", err)
+	}
+	req, _ := http.NewRequest("POST", "http://l2met.net/logs", strings.NewReader(body))
+	req.Header.Set("Authorization", "Basic "+base64.URLEncoding.EncodeToString(append(tok, ':')))
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeHTTPReject(t *testing.T) {
+	cfg := &conf.D{BufferSize: 1, FlushInterval: 2500 * time.Millisecond, TenantInFlight: 1}
+	r := NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	// The tenant's only slot is held by another request.
+	r.tenants.acquire("u")
+	w := postLogs(t, r, logLines(1), nil)
+	if w.Code != 429 || w.Header().Get("Retry-After") != "3" {
+		t.Fatalf("actual=%d,%q expected=429,\"3\"\n", w.Code, w.Header().Get("Retry-After"))
+	}
+	r.tenants.release("u")
+	// Without starting the receiver nothing drains the inbox.
+	if err := r.Receive([]byte(logLines(1)), nil); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	w = postLogs(t, r, logLines(1), nil)
+	if w.Code != 503 || w.Header().Get("Retry-After") != "3" {
+		t.Fatalf("actual=%d,%q expected=503,\"3\"\n", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func registerCount(r *Receiver) int {
+	var n int
+	for i := range r.Register.shards {
+		for _, b := range r.Register.swap(i) {
+			n += b.Count()
+		}
+	}
+	return n
+}
+
+func TestServeHTTPDuplicate(t *testing.T) {
+	cfg := &conf.D{
+		Concurrency:      1,
+		BufferSize:       1,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+		DedupWindow:      time.Minute,
+	}
+	r := NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	hdr := map[string]string{"Logplex-Frame-Id": "frame-1"}
+	for i := 0; i < 2; i++ {
+		if w := postLogs(t, r, logLines(3), hdr); w.Code != 200 {
+			t.Fatalf("attempt=%d actual-code=%d expected-code=200\n", i, w.Code)
+		}
+	}
+	if n := registerCount(r); n != 3 {
+		t.Fatalf("actual=%d expected=3\n", n)
+	}
+}
+
+// A retry that arrives while the original is being handled must not
+// be acknowledged, as the original may still fail.
+func TestServeHTTPRetryWhilePending(t *testing.T) {
+	cfg := &conf.D{
+		Concurrency:      1,
+		BufferSize:       1,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+		DedupWindow:      time.Minute,
+	}
+	r := NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	hdr := map[string]string{"Logplex-Frame-Id": "frame-1"}
+	req, _ := http.NewRequest("POST", "http://l2met.net/logs", nil)
+	req.Header.Set("Logplex-Frame-Id", "frame-1")
+	// Stands in for the original request.
+	key, _ := r.claim(req, "u")
+	w := postLogs(t, r, logLines(3), hdr)
+	if w.Code != 503 || len(w.Header().Get("Retry-After")) == 0 {
+		t.Fatalf("actual-code=%d expected-code=503\n", w.Code)
+	}
+	// The original failed, so the next retry is accepted.
+	r.release(key)
+	if w := postLogs(t, r, logLines(3), hdr); w.Code != 200 {
+		t.Fatalf("actual-code=%d expected-code=200\n", w.Code)
+	}
+	if n := registerCount(r); n != 3 {
+		t.Fatalf("actual=%d expected=3\n", n)
+	}
+}
+
+func TestServeHTTPRetryAfterFailure(t *testing.T) {
+	cfg := &conf.D{
+		Concurrency:      1,
+		BufferSize:       1,
+		FlushInterval:    time.Hour,
+		ReceiverDeadline: 2,
+		DedupWindow:      time.Minute,
+		MaxBodySize:      16,
+	}
+	r := NewReceiver(cfg, store.NewMemStore())
+	r.Mchan = new(metchan.Channel)
+	r.Start()
+	hdr := map[string]string{"Logplex-Frame-Id": "frame-1"}
+	if w := postLogs(t, r, logLines(3), hdr); w.Code != 413 {
+		t.Fatalf("actual-code=%d expected-code=413\n", w.Code)
+	}
+	// The failed request released its claim, so the retry is accepted.
+	r.maxBodySize = 0
+	if w := postLogs(t, r, logLines(3), hdr); w.Code != 200 {
+		t.Fatalf("actual-code=%d expected-code=200\n", w.Code)
+	}
+	if n := registerCount(r); n != 3 {
+		t.Fatalf("actual=%d expected=3\n", n)
+	}
+}
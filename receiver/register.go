@@ -0,0 +1,159 @@
+package receiver
+
+import (
+	"github.com/ryandotsmith/l2met/bucket"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The register accumulates buckets in memory.
+// A seperate routine working on an interval will flush
+// the buckets from the register. Buckets are spread across
+// shards by their id so that accept routines rarely contend
+// for the same lock.
+type register struct {
+	shards []*shard
+	// Totals across all shards. Kept so that limits can
+	// be checked without locking every shard.
+	series, vals int64
+}
+
+type shard struct {
+	sync.Mutex
+	m    map[bucket.Id]*bucket.Bucket
+	vals int64
+}
+
+func newRegister(n int) *register {
+	if n < 1 {
+		n = 1
+	}
+	r := &register{shards: make([]*shard, n)}
+	for i := range r.shards {
+		r.shards[i] = &shard{m: make(map[bucket.Id]*bucket.Bucket)}
+	}
+	return r
+}
+
+// Adds the bucket to the register. If a bucket with the same
+// id is present, the buckets are merged and true is returned.
+func (r *register) add(b *bucket.Bucket) bool {
+	s := r.shards[r.shardFor(b.Id)]
+	s.Lock()
+	defer s.Unlock()
+	existing, present := s.m[*b.Id]
+	if !present {
+		s.m[*b.Id] = b
+		s.grow(r, int64(b.Size()))
+		atomic.AddInt64(&r.series, 1)
+		return false
+	}
+	// A merge into a sketch or HLL may not grow the bucket
+	// by the size of b, so we measure the bucket again.
+	before := existing.Size()
+	existing.Merge(b)
+	s.grow(r, int64(existing.Size()-before))
+	return true
+}
+
+// Must be called with the shard's lock held.
+func (s *shard) grow(r *register, n int64) {
+	s.vals += n
+	atomic.AddInt64(&r.vals, n)
+}
+
+// Replaces the shard's map with an empty map and returns the
+// old one. The lock is only held for the swap so that a slow
+// consumer of the buckets does not block the accept routines.
+func (r *register) swap(i int) map[bucket.Id]*bucket.Bucket {
+	s := r.shards[i]
+	s.Lock()
+	defer s.Unlock()
+	m := s.m
+	s.m = make(map[bucket.Id]*bucket.Bucket, len(m))
+	atomic.AddInt64(&r.series, -int64(len(m)))
+	atomic.AddInt64(&r.vals, -s.vals)
+	s.vals = 0
+	return m
+}
+
+// The number of buckets held in all shards.
+func (r *register) len() int {
+	return int(atomic.LoadInt64(&r.series))
+}
+
+// The memory held by all buckets measured in values.
+// See bucket.Size.
+func (r *register) numVals() int {
+	return int(atomic.LoadInt64(&r.vals))
+}
+
+// Returns true if the register holds more than maxSeries
+// buckets or maxVals values. A limit of 0 is ignored.
+func (r *register) over(maxSeries, maxVals int) bool {
+	return (maxSeries > 0 && r.len() > maxSeries) ||
+		(maxVals > 0 && r.numVals() > maxVals)
+}
+
+// Removes buckets from the register, largest first, until
+// it holds no more than maxSeries buckets and maxVals values.
+// Large buckets free the most memory per store write. Unlike
+// over, a limit of 0 evicts everything and a negative limit
+// is ignored.
+func (r *register) evict(maxSeries, maxVals int) []*bucket.Bucket {
+	above := func() bool {
+		return (maxSeries >= 0 && r.len() > maxSeries) ||
+			(maxVals >= 0 && r.numVals() > maxVals)
+	}
+	type entry struct {
+		shard int
+		id    bucket.Id
+		n     int
+	}
+	var entries []entry
+	for i, s := range r.shards {
+		s.Lock()
+		for id, b := range s.m {
+			entries = append(entries, entry{i, id, b.Size()})
+		}
+		s.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].n > entries[j].n
+	})
+	var evicted []*bucket.Bucket
+	for _, e := range entries {
+		if !above() {
+			break
+		}
+		s := r.shards[e.shard]
+		s.Lock()
+		// The bucket may have been transferred since we looked.
+		if b, ok := s.m[e.id]; ok {
+			delete(s.m, e.id)
+			s.grow(r, -int64(b.Size()))
+			atomic.AddInt64(&r.series, -1)
+			evicted = append(evicted, b)
+		}
+		s.Unlock()
+	}
+	return evicted
+}
+
+// Id.Partition gob encodes the id, which is too slow for every
+// bucket we accept. FNV over the identifying fields is enough here.
+func (r *register) shardFor(id *bucket.Id) int {
+	if len(r.shards) == 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id.Auth))
+	h.Write([]byte(id.Name))
+	h.Write([]byte(id.Source))
+	t := id.Time.UnixNano() / int64(time.Second)
+	h.Write([]byte{byte(t), byte(t >> 8), byte(t >> 16), byte(t >> 24)})
+	return int(h.Sum64() % uint64(len(r.shards)))
+}
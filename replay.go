@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/outlet"
+	"github.com/ryandotsmith/l2met/replay"
+	"io"
+	"os"
+)
+
+// l2met [flags] replay [-deliver] [-format logfmt|json] capture.jsonl
+// The receiver flags (e.g. -recv-deadline) apply to the replay.
+// $SECRETS must contain the secret used to sign the captured auth.
+// The metrics are written to stdout and diagnostics to stderr.
+func replayCmd(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	deliver := fs.Bool("deliver", false,
+		"Post the metrics to Librato instead of printing them.")
+	format := fs.String("format", "logfmt",
+		"Print metrics as logfmt or json.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(stderr, "usage: l2met replay [flags] capture.jsonl\n")
+		return 2
+	}
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "at=replay error=%s\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	reqs, err := replay.Read(in)
+	if err != nil {
+		fmt.Fprintf(stderr, "at=replay error=%s\n", err)
+		return 1
+	}
+	c := *cfg
+	c.Log = stderr
+	mchan := metchan.New(&c)
+	buckets, err := replay.Run(&c, reqs, mchan)
+	if err != nil {
+		fmt.Fprintf(stderr, "at=replay error=%s\n", err)
+		return 1
+	}
+	var metrics []*bucket.LibratoMetric
+	for _, b := range buckets {
+		metrics = append(metrics, b.Metrics()...)
+	}
+	if *deliver {
+		out := outlet.NewLibratoOutlet(&c, nil)
+		out.Mchan = mchan
+		out.Deliver(metrics)
+		fmt.Fprintf(stderr, "at=replay-delivered metrics=%d\n", len(metrics))
+		return 0
+	}
+	if err := outlet.WriteMetrics(stdout, *format, metrics); err != nil {
+		fmt.Fprintf(stderr, "at=replay error=%s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+// The replay pkg pushes captured drain requests through the
+// receiver on a simulated clock. This lets us reproduce the
+// metrics l2met computed for a drain without live traffic,
+// Redis or Librato.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/receiver"
+	"github.com/ryandotsmith/l2met/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A captured request to the receiver. Captures are
+// stored as one JSON object per line.
+type Request struct {
+	// The time at which the request was received.
+	Time time.Time `json:"time"`
+	// E.g. Authorization, Content-Encoding and Logplex-Frame-Id
+	Header map[string]string `json:"header"`
+	// The raw query string. E.g. resolution=1&source-prefix=web
+	Query string `json:"query"`
+	Body  string `json:"body"`
+	// Compressed bodies are captured as base64 in body64.
+	Body64 []byte `json:"body64,omitempty"`
+}
+
+// Reads captured requests until EOF.
+func Read(r io.Reader) ([]*Request, error) {
+	var reqs []*Request
+	dec := json.NewDecoder(r)
+	for {
+		req := new(Request)
+		err := dec.Decode(req)
+		if err == io.EOF {
+			return reqs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replay: request %d: %s", len(reqs)+1, err)
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+func (req *Request) httpRequest() (*http.Request, error) {
+	body := req.Body64
+	if len(body) == 0 {
+		body = []byte(req.Body)
+	}
+	hr, err := http.NewRequest("POST", "/logs?"+req.Query, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		hr.Header.Set(k, v)
+	}
+	return hr, nil
+}
+
+// Runs the requests through a receiver backed by a MemStore.
+// Before each request is received, the simulated clock is moved to
+// the time of the request so that deadlines and late policies apply
+// as they did when the request was captured. Requests without a time
+// are received at the time of the previous request. Diagnostics are
+// written to the log of mchan. Returns the resulting buckets ordered
+// by time, name and source.
+func Run(cfg *conf.D, reqs []*Request, mchan *metchan.Channel) ([]*bucket.Bucket, error) {
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+	sim := clock.NewSim(reqs[0].Time)
+	c := *cfg
+	c.Clock = sim
+	c.SyncAck = false
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	if c.BufferSize < 1 {
+		c.BufferSize = 1
+	}
+	st := store.NewMemStore()
+	st.Clock = sim
+	recv := receiver.NewReceiver(&c, st)
+	recv.Mchan = mchan
+	recv.Start()
+	for i, req := range reqs {
+		if !req.Time.IsZero() {
+			sim.Set(req.Time)
+		}
+		hr, err := req.httpRequest()
+		if err != nil {
+			recv.Stop()
+			return nil, fmt.Errorf("replay: request %d: %s", i+1, err)
+		}
+		w := httptest.NewRecorder()
+		recv.ServeHTTP(w, hr)
+		if w.Code != 200 {
+			mchan.Printf("at=replay-request n=%d code=%d msg=%q\n",
+				i+1, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+	recv.Stop()
+	// All of the buckets are ready at the end of time.
+	ch, err := st.Scan(time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		return nil, err
+	}
+	var buckets []*bucket.Bucket
+	for b := range ch {
+		buckets = append(buckets, b)
+	}
+	sort.Sort(bucket.ByTime(buckets))
+	return buckets, nil
+}
@@ -0,0 +1,68 @@
+package replay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"strings"
+	"testing"
+	"time"
+)
+
+func logLine(t time.Time, msg string) string {
+	ts := t.Format("2006-01-02T15:04:05+00:00")
+	packet := fmt.Sprintf("<190>1 %s hostname app web - %s", ts, msg)
+	return fmt.Sprintf("%d %s", len(packet), packet)
+}
+
+// A drain sends the same token with every request.
+func capture(tok []byte, at, logged time.Time, msg string) string {
+	hdr := "Basic " + base64.URLEncoding.EncodeToString(append(tok, ':'))
+	return fmt.Sprintf(`{"time":%q,"header":{"Authorization":%q},"query":"resolution=60","body":%q}`,
+		at.Format(time.RFC3339), hdr, logLine(logged, msg))
+}
+
+func TestRun(t *testing.T) {
+	tok, err := auth.EncryptAndSign([]byte("u:p"))
+	if err != nil {
+		t.Fatalf("Must set $SECRETS error=%s\n", err)
+	}
+	start := time.Date(2013, 5, 7, 12, 0, 0, 0, time.UTC)
+	in := strings.Join([]string{
+		capture(tok, start, start, "measure#a=1 count#c=1"),
+		capture(tok, start.Add(10*time.Second), start.Add(10*time.Second), "measure#a=3"),
+		// Past the deadline when it was received.
+		capture(tok, start.Add(10*time.Minute), start, "measure#a=5"),
+	}, "\n")
+	reqs, err := Read(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	cfg := &conf.D{BufferSize: 10, FlushInterval: time.Second, ReceiverDeadline: 2}
+	buckets, err := Run(cfg, reqs, new(metchan.Channel))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("actual=%d expected=2\n", len(buckets))
+	}
+	a, c := buckets[0], buckets[1]
+	if a.Id.Name != "a" || a.Count() != 2 || a.Sum() != 4 {
+		t.Fatalf("actual=%s sum=%f expected=a with 1 & 3\n", a, a.Sum())
+	}
+	if c.Id.Name != "c" || c.Sum() != 1 {
+		t.Fatalf("actual=%s expected=c with 1\n", c)
+	}
+	if !a.Id.Time.Equal(start) {
+		t.Fatalf("actual=%s expected=%s\n", a.Id.Time, start)
+	}
+}
+
+func TestReadError(t *testing.T) {
+	_, err := Read(strings.NewReader("{}\n{"))
+	if err == nil || !strings.Contains(err.Error(), "request 2") {
+		t.Fatalf("actual-err=%v expected request 2 to fail\n", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/ryandotsmith/l2met/auth"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayCmdOutput(t *testing.T) {
+	tok, err := auth.EncryptAndSign([]byte("u:p"))
+	if err != nil {
+		t.Fatalf("Must set $SECRETS error=%s\n", err)
+	}
+	at := time.Date(2013, 5, 7, 12, 0, 0, 0, time.UTC)
+	packet := fmt.Sprintf("<190>1 %s hostname app web - measure#a=1",
+		at.Format("2006-01-02T15:04:05+00:00"))
+	body := fmt.Sprintf("%d %s", len(packet), packet)
+	hdr := "Basic " + base64.URLEncoding.EncodeToString(append(tok, ':'))
+	capture := strings.Join([]string{
+		fmt.Sprintf(`{"time":%q,"header":{"Authorization":%q},"body":%q}`,
+			at.Format(time.RFC3339), hdr, body),
+		// Rejected for its auth.
+		fmt.Sprintf(`{"time":%q,"body":%q}`, at.Format(time.RFC3339), body),
+	}, "\n")
+	f, err := ioutil.TempFile("", "l2met-replay")
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(capture)
+	f.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := replayCmd([]string{f.Name()}, &stdout, &stderr); code != 0 {
+		t.Fatalf("actual-code=%d expected-code=0 stderr=%s\n", code, stderr.String())
+	}
+	// The report holds nothing but the metrics.
+	for _, l := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		if !strings.HasPrefix(l, "measure_time=") {
+			t.Fatalf("actual=%q expected a metric\n", l)
+		}
+	}
+	if len(stdout.String()) == 0 {
+		t.Fatalf("Expected metrics on stdout.\n")
+	}
+	if !strings.Contains(stderr.String(), "at=replay-request") {
+		t.Fatalf("actual-stderr=%q expected the rejected request\n", stderr.String())
+	}
+}
@@ -0,0 +1,97 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Lower rates would weight a single value beyond
+// the counts that a bucket can represent.
+const minSampleRate = 1e-9
+
+// A single StatsD metric. E.g. api.latency:12|ms|@0.5|#source:web
+type line struct {
+	Name string
+	// The raw value. Sets keep this as a string, all other
+	// types have their value parsed into Val.
+	Raw  string
+	Val  float64
+	Type string
+	Rate float64
+	Tags map[string]string
+}
+
+// Parses the StatsD & DogStatsD line format:
+// <name>:<value>|<type>[|@<rate>][|#<tag>:<val>,<tag>]
+// DogStatsD events (_e) and service checks (_sc) are not supported.
+func parseLine(b []byte) (*line, error) {
+	b = bytes.TrimSpace(b)
+	if bytes.HasPrefix(b, []byte("_e{")) || bytes.HasPrefix(b, []byte("_sc|")) {
+		return nil, errors.New("Events & service checks are not supported.")
+	}
+	pipe := bytes.Index(b, []byte("|"))
+	if pipe < 0 {
+		return nil, errors.New("Malformed statsd line.")
+	}
+	colon := bytes.LastIndex(b[:pipe], []byte(":"))
+	if colon < 1 {
+		return nil, errors.New("Malformed statsd line.")
+	}
+	l := &line{Name: string(b[:colon]), Rate: 1}
+	l.Raw = string(b[colon+1 : pipe])
+	fields := strings.Split(string(b[pipe+1:]), "|")
+	l.Type = fields[0]
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			// Written so that NaN is rejected too.
+			if err != nil || !(rate >= minSampleRate && rate <= 1) {
+				return nil, errors.New("Invalid sample rate.")
+			}
+			l.Rate = rate
+		case strings.HasPrefix(f, "#"):
+			l.Tags = parseTags(f[1:])
+		}
+	}
+	switch l.Type {
+	case "c", "ms", "h":
+	case "g":
+		// Relative gauges (e.g. +3|g) depend on the previous
+		// value of the gauge. Samples in l2met are stateless.
+		if strings.HasPrefix(l.Raw, "+") || strings.HasPrefix(l.Raw, "-") {
+			return nil, errors.New("Relative gauges are not supported.")
+		}
+	case "s":
+		return l, nil
+	default:
+		return nil, errors.New("Unknown statsd type: " + l.Type)
+	}
+	v, err := strconv.ParseFloat(l.Raw, 64)
+	if err != nil {
+		return nil, err
+	}
+	// ParseFloat accepts NaN and Inf, which sketches
+	// cannot bin and Librato cannot accept.
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, errors.New("Value must be a finite number.")
+	}
+	l.Val = v
+	return l, nil
+}
+
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(s, ",") {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+	return tags
+}
@@ -0,0 +1,124 @@
+package statsd
+
+import (
+	"github.com/ryandotsmith/l2met/bucket"
+	"testing"
+	"time"
+)
+
+var lineTest = []struct {
+	in    string
+	name  string
+	typ   string
+	val   float64
+	rate  float64
+	tags  map[string]string
+	isErr bool
+}{
+	{"hello:1|c", "hello", "c", 1, 1, nil, false},
+	{"hello:1|c|@0.1", "hello", "c", 1, 0.1, nil, false},
+	{"db.latency:4.5|ms", "db.latency", "ms", 4.5, 1, nil, false},
+	{"db.size:100|g", "db.size", "g", 100, 1, nil, false},
+	{"hist:3|h|@0.5|#source:web,canary", "hist", "h", 3, 0.5,
+		map[string]string{"source": "web", "canary": ""}, false},
+	{"users:abc|s", "users", "s", 0, 1, nil, false},
+	{"db.size:+1|g", "", "", 0, 0, nil, true},
+	{"hello:1|x", "", "", 0, 0, nil, true},
+	{"hello:1|c|@2", "", "", 0, 0, nil, true},
+	{"x:1|ms|@0.0000000001", "", "", 0, 0, nil, true},
+	{"x:1|ms|@NaN", "", "", 0, 0, nil, true},
+	{"x:NaN|ms", "", "", 0, 0, nil, true},
+	{"x:Inf|c", "", "", 0, 0, nil, true},
+	{"x:-infinity|h", "", "", 0, 0, nil, true},
+	{"hello", "", "", 0, 0, nil, true},
+	{"_e{5,4}:title|text", "", "", 0, 0, nil, true},
+}
+
+func TestParseLine(t *testing.T) {
+	for _, ts := range lineTest {
+		l, err := parseLine([]byte(ts.in))
+		if ts.isErr {
+			if err == nil {
+				t.Errorf("input=%s expected error\n", ts.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("input=%s error=%s\n", ts.in, err)
+			continue
+		}
+		if l.Name != ts.name || l.Type != ts.typ {
+			t.Errorf("input=%s actual-name=%s actual-type=%s\n",
+				ts.in, l.Name, l.Type)
+		}
+		if l.Val != ts.val || l.Rate != ts.rate {
+			t.Errorf("input=%s actual-val=%f actual-rate=%f\n",
+				ts.in, l.Val, l.Rate)
+		}
+		for k, v := range ts.tags {
+			if l.Tags[k] != v {
+				t.Errorf("input=%s tag=%s actual=%q expected=%q\n",
+					ts.in, k, l.Tags[k], v)
+			}
+		}
+	}
+}
+
+var bucketTest = []struct {
+	in    string
+	typ   string
+	count int
+	sum   float64
+	src   string
+}{
+	{"a:2|c|@0.5", "counter", 1, 4, ""},
+	{"a:7|g|#source:db", "sample", 1, 7, "db"},
+	{"a:3|ms|@0.25", "measurement", 4, 12, ""},
+	// A tiny rate is recorded as one weighted value.
+	{"a:3|ms|@0.000001", "measurement", 1000000, 3000000, ""},
+}
+
+func TestBuckets(t *testing.T) {
+	l := &Listener{resolution: time.Minute, sourceTags: []string{"source"}}
+	for _, ts := range bucketTest {
+		ln, err := parseLine([]byte(ts.in))
+		if err != nil {
+			t.Fatalf("input=%s error=%s\n", ts.in, err)
+		}
+		buckets := l.buckets(ln, time.Now())
+		if len(buckets) != 1 {
+			t.Fatalf("input=%s actual-len=%d\n", ts.in, len(buckets))
+		}
+		b := buckets[0]
+		sum := b.Sum()
+		if b.Id.Type != ts.typ || b.Count() != ts.count || sum != ts.sum {
+			t.Errorf("input=%s type=%s count=%d sum=%f\n",
+				ts.in, b.Id.Type, b.Count(), sum)
+		}
+		if len(b.Vals) > bucket.ExactValues {
+			t.Errorf("input=%s actual-vals=%d\n", ts.in, len(b.Vals))
+		}
+		if b.Id.Source != ts.src {
+			t.Errorf("input=%s actual-source=%s\n", ts.in, b.Id.Source)
+		}
+	}
+}
+
+func TestSets(t *testing.T) {
+	l := &Listener{resolution: time.Minute}
+	now := time.Now()
+	var merged *bucket.Bucket
+	for _, in := range []string{"u:a|s", "u:b|s", "u:a|s"} {
+		ln, _ := parseLine([]byte(in))
+		for _, b := range l.buckets(ln, now) {
+			if merged == nil {
+				merged = b
+			} else {
+				merged.Merge(b)
+			}
+		}
+	}
+	if merged.Id.Type != "unique" || merged.Uniques.Count() != 2 {
+		t.Errorf("actual=%s,%d expected=unique,2\n", merged.Id.Type, merged.Uniques.Count())
+	}
+}
@@ -0,0 +1,202 @@
+// The statsd pkg accepts StatsD & DogStatsD formatted lines over
+// UDP and TCP and places the resulting buckets into a receiver.
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/ryandotsmith/l2met/auth"
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"github.com/ryandotsmith/l2met/receiver"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// StatsD packets should fit in a single datagram.
+const maxPacketSize = 65535
+
+type Listener struct {
+	addr       string
+	auth       string
+	resolution time.Duration
+	sourceTags []string
+	recv       *receiver.Receiver
+	clock      clock.Clock
+	// Closed when the listener is stopped.
+	stop  chan struct{}
+	udp   *net.UDPConn
+	tcp   net.Listener
+	Mchan *metchan.Channel
+}
+
+func NewListener(cfg *conf.D, r *receiver.Receiver) *Listener {
+	l := new(Listener)
+	l.addr = cfg.StatsdAddr
+	l.auth = cfg.StatsdAuth
+	l.resolution = cfg.StatsdResolution
+	l.sourceTags = cfg.StatsdSourceTags
+	l.recv = r
+	l.clock = clock.Default(cfg.Clock)
+	l.stop = make(chan struct{})
+	return l
+}
+
+// Binds the UDP & TCP listeners. StatsD has no notion
+// of authentication, so all lines are attributed to the
+// encrypted credentials given in $STATSD_AUTH.
+func (l *Listener) Start() error {
+	if _, err := auth.Decrypt(l.auth); err != nil {
+		return fmt.Errorf("statsd: invalid STATSD_AUTH: %s", err)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", l.addr)
+	if err != nil {
+		return err
+	}
+	uc, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	tl, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		uc.Close()
+		return err
+	}
+	l.udp, l.tcp = uc, tl
+	go l.readUDP(uc)
+	go l.acceptTCP(tl)
+	return nil
+}
+
+// Closes the listeners. Lines that have already been read
+// will have been handed to the receiver.
+func (l *Listener) Stop() {
+	close(l.stop)
+	l.udp.Close()
+	l.tcp.Close()
+}
+
+func (l *Listener) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) readUDP(c *net.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := c.ReadFromUDP(buf)
+		if err != nil {
+			if l.stopped() {
+				return
+			}
+			fmt.Printf("at=statsd-udp error=%s\n", err)
+			continue
+		}
+		l.Handle(buf[:n])
+	}
+}
+
+func (l *Listener) acceptTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if l.stopped() {
+				return
+			}
+			fmt.Printf("at=statsd-tcp error=%s\n", err)
+			continue
+		}
+		go l.readTCP(c)
+	}
+}
+
+func (l *Listener) readTCP(c net.Conn) {
+	defer c.Close()
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		l.Handle(s.Bytes())
+	}
+}
+
+// Handle accepts one or more newline separated StatsD lines.
+func (l *Listener) Handle(b []byte) {
+	defer l.Mchan.Time("statsd.accept", time.Now())
+	for _, ln := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(ln)) == 0 {
+			continue
+		}
+		parsed, err := parseLine(ln)
+		if err != nil {
+			fmt.Printf("at=statsd-parse error=%s\n", err)
+			l.Mchan.Measure("statsd.parse-error", 1)
+			continue
+		}
+		for _, b := range l.buckets(parsed, l.clock.Now()) {
+			l.recv.ReceiveBucket(b)
+		}
+	}
+}
+
+func (l *Listener) buckets(ln *line, t time.Time) []*bucket.Bucket {
+	id := l.buildId(ln, t)
+	switch ln.Type {
+	case "c":
+		id.Type = "counter"
+		return []*bucket.Bucket{{Id: id, Vals: []float64{ln.Val / ln.Rate}}}
+	case "g":
+		id.Type = "sample"
+		return []*bucket.Bucket{{Id: id, Vals: []float64{ln.Val}}}
+	case "ms", "h":
+		id.Type = "measurement"
+		if ln.Type == "ms" {
+			id.Units = "ms"
+		}
+		// A sampled timer represents 1/rate observations.
+		// Weighting the value keeps the count correct without
+		// changing the distribution of the values.
+		b := &bucket.Bucket{Id: id}
+		b.AppendN(ln.Val, int(math.Floor(1/ln.Rate+0.5)))
+		return []*bucket.Bucket{b}
+	case "s":
+		// Sets count the distinct values seen in an interval.
+		// The receiver merges the buckets' HLLs.
+		id.Type = "unique"
+		b := &bucket.Bucket{Id: id}
+		b.AddUnique([]byte(ln.Raw))
+		return []*bucket.Bucket{b}
+	}
+	return nil
+}
+
+func (l *Listener) buildId(ln *line, t time.Time) *bucket.Id {
+	id := new(bucket.Id)
+	id.Resolution = l.resolution
+	id.Time = t.Truncate(l.resolution)
+	id.ReadyAt = id.Time.Add(l.resolution)
+	id.Auth = l.auth
+	id.Name = ln.Name
+	id.Source = l.source(ln.Tags)
+	return id
+}
+
+// Joins the values of the configured source tags.
+// E.g. with -statsd-source-tags=role,host and the tags
+// #role:web,host:a the source will be web.a
+func (l *Listener) source(tags map[string]string) string {
+	var parts []string
+	for _, k := range l.sourceTags {
+		if v, ok := tags[k]; ok && len(v) > 0 {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, ".")
+}
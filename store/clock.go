@@ -0,0 +1,125 @@
+package store
+
+import (
+	"fmt"
+	"github.com/ryandotsmith/l2met/clock"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"sync"
+	"time"
+)
+
+// Weight given to the newest drift sample.
+const driftAlpha = 0.2
+
+// Reading the time from the store is a network round trip, which
+// is too slow for the receive loop. The clock samples the store's
+// time on an interval and estimates the offset and drift of the
+// local clock so that Now is cheap and close to the store's time.
+type Clock struct {
+	str      Store
+	interval time.Duration
+	// The local clock.
+	local clock.Clock
+	sync.RWMutex
+	// The local time of the last sample and the
+	// offset of the store's time at that moment.
+	base   time.Time
+	offset time.Duration
+	// Change in offset per unit of local time.
+	drift   float64
+	samples int
+	stop    chan struct{}
+	Mchan   *metchan.Channel
+}
+
+// Until the clock is started, Now returns the local time.
+func NewClock(cfg *conf.D, st Store) *Clock {
+	c := new(Clock)
+	c.str = st
+	c.local = clock.Default(cfg.Clock)
+	c.interval = cfg.ClockInterval
+	if c.interval <= 0 {
+		c.interval = 10 * time.Second
+	}
+	c.stop = make(chan struct{})
+	return c
+}
+
+// Takes the first sample before returning so that
+// callers of Now see the store's time right away.
+func (c *Clock) Start() {
+	c.sample()
+	go c.schedule()
+}
+
+func (c *Clock) Stop() {
+	close(c.stop)
+}
+
+// The store's time estimated from the local clock.
+func (c *Clock) Now() time.Time {
+	local := c.local.Now()
+	c.RLock()
+	defer c.RUnlock()
+	if c.samples == 0 {
+		return local
+	}
+	elapsed := local.Sub(c.base)
+	return local.Add(c.offset + time.Duration(c.drift*float64(elapsed)))
+}
+
+// The current estimates of the offset and drift.
+func (c *Clock) Offset() (time.Duration, float64) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.offset, c.drift
+}
+
+func (c *Clock) schedule() {
+	ticker := c.local.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.sample()
+		}
+	}
+}
+
+// Assumes the store read its time halfway through the round trip.
+// A failed read is skipped and the estimate is left as it was.
+func (c *Clock) sample() {
+	t0 := c.local.Now()
+	st, err := c.str.Now()
+	if err != nil {
+		fmt.Printf("at=store-clock error=%s\n", err)
+		c.Mchan.Measure("store.clock.error", 1)
+		return
+	}
+	rtt := c.local.Now().Sub(t0)
+	mid := t0.Add(rtt / 2)
+	c.record(mid, st.Sub(mid))
+	c.Mchan.Measure("store.clock.rtt", float64(rtt/time.Millisecond))
+	off, _ := c.Offset()
+	c.Mchan.Measure("store.clock.offset", float64(off/time.Millisecond))
+}
+
+func (c *Clock) record(local time.Time, offset time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	elapsed := local.Sub(c.base)
+	if c.samples > 0 && elapsed > 0 {
+		d := float64(offset-c.offset) / float64(elapsed)
+		if c.samples == 1 {
+			c.drift = d
+		} else {
+			c.drift = driftAlpha*d + (1-driftAlpha)*c.drift
+		}
+	}
+	c.base = local
+	c.offset = offset
+	c.samples++
+}
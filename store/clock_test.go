@@ -0,0 +1,78 @@
+package store
+
+import (
+	"errors"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"testing"
+	"time"
+)
+
+// A store whose clock is ahead of the local clock.
+type skewStore struct {
+	*MemStore
+	skew time.Duration
+}
+
+func (s *skewStore) Now() (time.Time, error) {
+	return time.Now().Add(s.skew), nil
+}
+
+// A store whose time cannot be read.
+type downStore struct {
+	*MemStore
+}
+
+func (s *downStore) Now() (time.Time, error) {
+	return time.Time{}, errors.New("down")
+}
+
+func TestClockOffset(t *testing.T) {
+	st := &skewStore{NewMemStore(), time.Minute}
+	c := NewClock(&conf.D{ClockInterval: time.Hour}, st)
+	c.Mchan = new(metchan.Channel)
+	if d := c.Now().Sub(time.Now()); d > time.Second {
+		t.Fatalf("Expected local time before start. actual-offset=%s\n", d)
+	}
+	c.Start()
+	defer c.Stop()
+	d := c.Now().Sub(time.Now()) - time.Minute
+	if d < -50*time.Millisecond || d > 50*time.Millisecond {
+		t.Fatalf("actual-error=%s expected-error<50ms\n", d)
+	}
+}
+
+func TestClockDrift(t *testing.T) {
+	c := NewClock(&conf.D{}, NewMemStore())
+	t0 := time.Now()
+	// The store gains 1ms every second.
+	for i := 0; i < 3; i++ {
+		c.record(t0.Add(time.Duration(i)*10*time.Second),
+			time.Duration(i)*10*time.Millisecond)
+	}
+	off, drift := c.Offset()
+	if off != 20*time.Millisecond {
+		t.Fatalf("actual-offset=%s expected-offset=20ms\n", off)
+	}
+	if drift < 0.00099 || drift > 0.00101 {
+		t.Fatalf("actual-drift=%f expected-drift=0.001\n", drift)
+	}
+}
+
+func TestClockSampleError(t *testing.T) {
+	st := &skewStore{NewMemStore(), time.Minute}
+	c := NewClock(&conf.D{ClockInterval: time.Hour}, st)
+	c.Mchan = new(metchan.Channel)
+	c.sample()
+	before, _ := c.Offset()
+	// Failed reads must not be taken as an offset of zero.
+	c.str = &downStore{NewMemStore()}
+	c.sample()
+	after, _ := c.Offset()
+	if after != before || c.samples != 1 {
+		t.Fatalf("actual-offset=%s expected-offset=%s samples=%d\n", after, before, c.samples)
+	}
+	if d := c.Now().Sub(time.Now()); d < 50*time.Second {
+		t.Fatalf("actual-offset=%s expected-offset=1m\n", d)
+	}
+}
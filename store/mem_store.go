@@ -3,6 +3,7 @@ package store
 import (
 	"errors"
 	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
 	"net/http"
 	"sync"
 	"time"
@@ -11,10 +12,38 @@ import (
 type MemStore struct {
 	sync.Mutex
 	m map[bucket.Id]*bucket.Bucket
+	// The values of buckets that have been scanned. Kept for
+	// Retention so that late data produces a corrected bucket.
+	scanned map[bucket.Id]*bucket.Bucket
+	// Claimed keys, their state and expiration.
+	claimsMut  sync.Mutex
+	claims     map[string]claim
+	lastExpire time.Time
+	// Running totals and their expiration.
+	totalsMut       sync.Mutex
+	totals          map[string]total
+	lastTotalExpire time.Time
+	Clock           clock.Clock
+}
+
+type claim struct {
+	state ClaimState
+	exp   time.Time
+}
+
+type total struct {
+	val float64
+	exp time.Time
 }
 
 func NewMemStore() *MemStore {
-	return &MemStore{m: make(map[bucket.Id]*bucket.Bucket)}
+	return &MemStore{
+		m:       make(map[bucket.Id]*bucket.Bucket),
+		scanned: make(map[bucket.Id]*bucket.Bucket),
+		claims:  make(map[string]claim),
+		totals:  make(map[string]total),
+		Clock:   clock.Real,
+	}
 }
 
 func (s *MemStore) Health() bool {
@@ -25,8 +54,8 @@ func (m *MemStore) MaxPartitions() uint64 {
 	return uint64(1)
 }
 
-func (m *MemStore) Now() time.Time {
-	return time.Now()
+func (m *MemStore) Now() (time.Time, error) {
+	return m.Clock.Now(), nil
 }
 
 func (m *MemStore) Scan(schedule time.Time) (<-chan *bucket.Bucket, error) {
@@ -36,10 +65,18 @@ func (m *MemStore) Scan(schedule time.Time) (<-chan *bucket.Bucket, error) {
 	go func(out chan *bucket.Bucket) {
 		defer m.Unlock()
 		defer close(out)
+		for k := range m.scanned {
+			if k.ReadyAt.Add(Retention).Before(schedule) {
+				delete(m.scanned, k)
+			}
+		}
 		for k, v := range m.m {
 			ready := v.Id.Time.Add(v.Id.Resolution).Add(time.Second)
 			if !ready.After(schedule) {
 				delete(m.m, k)
+				read := &bucket.Bucket{Id: v.Id}
+				read.Merge(v)
+				m.scanned[k] = read
 				out <- v
 			}
 		}
@@ -58,13 +95,88 @@ func (m *MemStore) Get(b *bucket.Bucket) error {
 	return nil
 }
 
-func (m *MemStore) Put(b *bucket.Bucket) error {
+// Buckets are read by their ReadyAt, so the store's time is not needed.
+func (m *MemStore) Put(b *bucket.Bucket, now time.Time) error {
 	m.Lock()
 	defer m.Unlock()
-	if _, present := m.m[*b.Id]; !present {
-		m.m[*b.Id] = b
-	} else {
-		m.m[*b.Id].Merge(b)
+	// We copy the values into our own bucket.
+	existing, present := m.m[*b.Id]
+	if !present {
+		existing = &bucket.Bucket{Id: b.Id}
+		if read, ok := m.scanned[*b.Id]; ok {
+			// Late data for a bucket that has been read.
+			// The bucket will be read again with all of its values.
+			delete(m.scanned, *b.Id)
+			existing = read
+		}
+		m.m[*b.Id] = existing
+	}
+	existing.Merge(b)
+	return nil
+}
+
+func (m *MemStore) Claim(key string, ttl time.Duration) (ClaimState, error) {
+	m.claimsMut.Lock()
+	defer m.claimsMut.Unlock()
+	now := m.Clock.Now()
+	// Expired keys are removed at most once per ttl.
+	if now.Sub(m.lastExpire) > ttl {
+		for k, c := range m.claims {
+			if now.After(c.exp) {
+				delete(m.claims, k)
+			}
+		}
+		m.lastExpire = now
+	}
+	if c, present := m.claims[key]; present && now.Before(c.exp) {
+		return c.state, nil
+	}
+	m.claims[key] = claim{Pending, now.Add(ttl)}
+	return Claimed, nil
+}
+
+func (m *MemStore) Commit(key string, ttl time.Duration) error {
+	m.claimsMut.Lock()
+	defer m.claimsMut.Unlock()
+	m.claims[key] = claim{Committed, m.Clock.Now().Add(ttl)}
+	return nil
+}
+
+func (m *MemStore) Release(key string) error {
+	m.claimsMut.Lock()
+	defer m.claimsMut.Unlock()
+	delete(m.claims, key)
+	return nil
+}
+
+// The buckets are put while the totals are locked. Puts to
+// the memory store do not fail, so both are always kept.
+func (m *MemStore) UpdateTotals(keys []string, ttl time.Duration, storeTime time.Time, next func([]float64, []bool) ([]float64, []*bucket.Bucket)) error {
+	m.totalsMut.Lock()
+	defer m.totalsMut.Unlock()
+	now := m.Clock.Now()
+	// Expired totals are removed at most once per ttl.
+	if now.Sub(m.lastTotalExpire) > ttl {
+		for k, t := range m.totals {
+			if now.After(t.exp) {
+				delete(m.totals, k)
+			}
+		}
+		m.lastTotalExpire = now
+	}
+	prev := make([]float64, len(keys))
+	present := make([]bool, len(keys))
+	for i, k := range keys {
+		if t, ok := m.totals[k]; ok && !now.After(t.exp) {
+			prev[i], present[i] = t.val, true
+		}
+	}
+	totals, buckets := next(prev, present)
+	for _, b := range buckets {
+		m.Put(b, storeTime)
+	}
+	for i, v := range totals {
+		m.totals[keys[i]] = total{v, now.Add(ttl)}
 	}
 	return nil
 }
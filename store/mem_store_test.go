@@ -0,0 +1,40 @@
+package store
+
+import (
+	"github.com/ryandotsmith/l2met/bucket"
+	"testing"
+	"time"
+)
+
+func TestMemStoreLatePut(t *testing.T) {
+	st := NewMemStore()
+	ts := time.Now().Add(-2 * time.Minute).Truncate(time.Minute)
+	id := &bucket.Id{Name: "test", Time: ts, Resolution: time.Minute,
+		ReadyAt: ts.Add(time.Minute)}
+	st.Put(&bucket.Bucket{Id: id, Vals: []float64{1, 2}}, time.Now())
+	for _ = range mustScan(t, st) {
+	}
+	// The interval has been read. A late put should
+	// produce a bucket with all of the interval's values.
+	late := *id
+	st.Put(&bucket.Bucket{Id: &late, Vals: []float64{3}}, time.Now())
+	buckets := mustScan(t, st)
+	if len(buckets) != 1 {
+		t.Fatalf("actual=%d expected=1\n", len(buckets))
+	}
+	if buckets[0].Count() != 3 || buckets[0].Sum() != 6 {
+		t.Fatalf("actual=%d,%f expected=3,6\n", buckets[0].Count(), buckets[0].Sum())
+	}
+}
+
+func mustScan(t *testing.T, st Store) []*bucket.Bucket {
+	ch, err := st.Scan(time.Now())
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var buckets []*bucket.Bucket
+	for b := range ch {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
@@ -14,9 +14,16 @@ import (
 	"time"
 )
 
+var ErrTotalsConflict = errors.New("redis_store: Totals changed on every attempt.")
+
+// Attempts made by UpdateTotals before returning ErrTotalsConflict.
+const maxTotalAttempts = 5
+
 const (
 	lockPrefix      = "lock"
 	partitionPrefix = "partition.outlet"
+	claimPrefix     = "claim"
+	totalPrefix     = "total"
 )
 
 func initRedisPool(cfg *conf.D) *redis.Pool {
@@ -63,26 +70,26 @@ func (s *RedisStore) Health() bool {
 }
 
 // Reads the TIME from Redis.
-func (s *RedisStore) Now() time.Time {
+func (s *RedisStore) Now() (time.Time, error) {
 	rc := s.redisPool.Get()
 	defer rc.Close()
 	defer s.Mchan.Time("store.time", time.Now())
-	reply, err := redis.Values(rc.Do("TIME"))
+	reply, err := redis.Strings(rc.Do("TIME"))
 	if err != nil {
-		fmt.Printf("error=redis-time-not-available\n")
-		return time.Now()
+		return time.Time{}, err
 	}
-	sec, err := strconv.Atoi(string(reply[0].([]byte)))
+	if len(reply) != 2 {
+		return time.Time{}, errors.New("redis_store: Malformed TIME reply.")
+	}
+	sec, err := strconv.ParseInt(reply[0], 10, 64)
 	if err != nil {
-		fmt.Printf("error=redis-time-not-available\n")
-		return time.Now()
+		return time.Time{}, err
 	}
-	microSec, err := strconv.Atoi(string(reply[1].([]byte)))
+	microSec, err := strconv.ParseInt(reply[1], 10, 64)
 	if err != nil {
-		fmt.Printf("error=redis-time-not-available\n")
-		return time.Now()
+		return time.Time{}, err
 	}
-	return time.Unix(int64(sec), int64(microSec*1000))
+	return time.Unix(sec, microSec*1000), nil
 }
 
 func (s *RedisStore) Scan(schedule time.Time) (<-chan *bucket.Bucket, error) {
@@ -121,34 +128,42 @@ func (s *RedisStore) Scan(schedule time.Time) (<-chan *bucket.Bucket, error) {
 	return out, nil
 }
 
-func (s *RedisStore) Put(b *bucket.Bucket) error {
+func (s *RedisStore) Put(b *bucket.Bucket, now time.Time) error {
 	defer s.Mchan.Time("store.put", time.Now())
-	b.Lock()
-	defer b.Unlock()
 	rc := s.redisPool.Get()
 	defer rc.Close()
-
-	idBytes, err := b.Id.Encode()
-	if err != nil {
+	rc.Send("MULTI")
+	if err := s.sendPut(rc, b, now); err != nil {
+		rc.Do("DISCARD")
 		return err
 	}
-	payload := make([]interface{}, len(b.Vals)+1)
-	payload[0] = idBytes
-	for i := range b.Vals {
-		x := strconv.FormatFloat(b.Vals[i], 'f', 10, 64)
-		payload[i+1] = []byte(x)
+	_, err := rc.Do("EXEC")
+	if err != nil {
+		return err
 	}
+	return nil
+}
 
-	p := namePartition(b.Id.ReadyAt, b.Id.Partition(s.maxPartitions))
-	rc.Send("MULTI")
-	rc.Send("RPUSH", payload...)
-	rc.Send("EXPIRE", payload[0], 300)
-	rc.Send("SADD", p, payload[0])
-	rc.Send("EXPIRE", p, 300)
-	_, err = rc.Do("EXEC")
+// Queues the commands that write the bucket. The caller
+// wraps them in a transaction.
+func (s *RedisStore) sendPut(rc redis.Conn, b *bucket.Bucket, now time.Time) error {
+	idBytes, err := b.Id.Encode()
 	if err != nil {
 		return err
 	}
+	// The values are pushed as a single entry. A hot series
+	// sends a sketch of its values rather than every value.
+	vals := b.EncodeVals()
+
+	ready := schedule(b.Id, now)
+	p := namePartition(ready, b.Id.Partition(s.maxPartitions))
+	// The values outlive the partition so that a late
+	// put will append to the values that were already read.
+	ttl := int(Retention / time.Second)
+	rc.Send("RPUSH", idBytes, vals)
+	rc.Send("EXPIRE", idBytes, ttl)
+	rc.Send("SADD", p, idBytes)
+	rc.Send("EXPIRE", p, ttl)
 	return nil
 }
 
@@ -168,10 +183,14 @@ func (s *RedisStore) Get(b *bucket.Bucket) error {
 	if len(reply) == 0 {
 		return errors.New("redis_store: Empty bucket.")
 	}
-	b.Vals = make([]float64, 0, len(reply))
+	b.Reset()
 	for i := range reply {
-		numstr := reply[i].([]byte)
-		numf, err := strconv.ParseFloat(string(numstr), 64)
+		entry := reply[i].([]byte)
+		if err := b.MergeEncoded(entry); err == nil {
+			continue
+		}
+		// Values pushed before the encoding was introduced.
+		numf, err := strconv.ParseFloat(string(entry), 64)
 		if err == nil {
 			b.Append(numf)
 		}
@@ -179,6 +198,110 @@ func (s *RedisStore) Get(b *bucket.Bucket) error {
 	return nil
 }
 
+// Uses SET NX so that the claim is shared by all receivers.
+// The value of the key is its state.
+func (s *RedisStore) Claim(key string, ttl time.Duration) (ClaimState, error) {
+	defer s.Mchan.Time("store.claim", time.Now())
+	rc := s.redisPool.Get()
+	defer rc.Close()
+	ms := int64(ttl / time.Millisecond)
+	_, err := redis.String(rc.Do("SET", nameClaim(key), int(Pending), "PX", ms, "NX"))
+	if err == nil {
+		return Claimed, nil
+	}
+	if err != redis.ErrNil {
+		return Claimed, err
+	}
+	state, err := redis.Int(rc.Do("GET", nameClaim(key)))
+	if err == redis.ErrNil {
+		// The key expired after the SET. The client will
+		// retry and the next attempt will claim the key.
+		return Pending, nil
+	}
+	if err != nil {
+		return Claimed, err
+	}
+	return ClaimState(state), nil
+}
+
+func (s *RedisStore) Commit(key string, ttl time.Duration) error {
+	rc := s.redisPool.Get()
+	defer rc.Close()
+	ms := int64(ttl / time.Millisecond)
+	_, err := rc.Do("SET", nameClaim(key), int(Committed), "PX", ms)
+	return err
+}
+
+func (s *RedisStore) Release(key string) error {
+	rc := s.redisPool.Get()
+	defer rc.Close()
+	_, err := rc.Do("DEL", nameClaim(key))
+	return err
+}
+
+// Receivers sharing a series may update its total at the same
+// time. The totals are watched and the update is retried if
+// another receiver changed one of them before it was written.
+// The buckets are written in the transaction that sets the totals.
+func (s *RedisStore) UpdateTotals(keys []string, ttl time.Duration, now time.Time, next func([]float64, []bool) ([]float64, []*bucket.Bucket)) error {
+	defer s.Mchan.Time("store.update-totals", time.Now())
+	if len(keys) == 0 {
+		return nil
+	}
+	rc := s.redisPool.Get()
+	defer rc.Close()
+	names := make([]interface{}, len(keys))
+	for i, k := range keys {
+		names[i] = nameTotal(k)
+	}
+	ms := int64(ttl / time.Millisecond)
+	for attempt := 0; attempt < maxTotalAttempts; attempt++ {
+		if _, err := rc.Do("WATCH", names...); err != nil {
+			return err
+		}
+		reply, err := redis.Values(rc.Do("MGET", names...))
+		if err != nil {
+			return err
+		}
+		prev := make([]float64, len(keys))
+		present := make([]bool, len(keys))
+		for i := range reply {
+			if reply[i] == nil {
+				continue
+			}
+			if prev[i], err = redis.Float64(reply[i], nil); err != nil {
+				return err
+			}
+			present[i] = true
+		}
+		totals, buckets := next(prev, present)
+		rc.Send("MULTI")
+		for i, v := range totals {
+			rc.Send("SET", names[i], strconv.FormatFloat(v, 'g', -1, 64), "PX", ms)
+		}
+		for _, b := range buckets {
+			if err := s.sendPut(rc, b, now); err != nil {
+				rc.Do("DISCARD")
+				return err
+			}
+		}
+		_, err = redis.Values(rc.Do("EXEC"))
+		if err != redis.ErrNil {
+			return err
+		}
+		s.Mchan.Measure("store.update-totals-conflict", 1)
+	}
+	return ErrTotalsConflict
+}
+
+func nameTotal(key string) string {
+	return fmt.Sprintf("%s.%s", totalPrefix, key)
+}
+
+func nameClaim(key string) string {
+	return fmt.Sprintf("%s.%s", claimPrefix, key)
+}
+
 func namePartition(schedule time.Time, n uint64) string {
 	return fmt.Sprintf("%d.%s.%d", schedule.Unix(), partitionPrefix, n)
 }
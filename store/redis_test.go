@@ -1,7 +1,9 @@
 package store
 
 import (
+	"github.com/garyburd/redigo/redis"
 	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/clock"
 	"github.com/ryandotsmith/l2met/conf"
 	"github.com/ryandotsmith/l2met/metchan"
 	"github.com/ryandotsmith/redisync"
@@ -19,7 +21,7 @@ func TestRedisGet(t *testing.T) {
 		Id:   id,
 		Vals: []float64{99.99999, 1, 0.2},
 	}
-	if err := st.Put(b1); err != nil {
+	if err := st.Put(b1, time.Now()); err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
@@ -57,7 +59,7 @@ func TestRedisScan(t *testing.T) {
 		Id:   id,
 		Vals: []float64{99.99999, 1, 0.2},
 	}
-	st.Put(b1)
+	st.Put(b1, time.Now())
 	bchan, err := st.Scan(schedule)
 	if err != nil {
 		t.Error(err)
@@ -96,3 +98,138 @@ func TestRedisLockPartition(t *testing.T) {
 		t.Errorf("Unable to lock partition.")
 	}
 }
+
+func TestRedisClaim(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+
+	for i, expected := range []ClaimState{Claimed, Pending} {
+		state, err := st.Claim("frame-1", time.Minute)
+		if err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+		if state != expected {
+			t.Fatalf("attempt=%d expected=%d actual=%d\n", i, expected, state)
+		}
+	}
+	if err := st.Release("frame-1"); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if state, _ := st.Claim("frame-1", time.Minute); state != Claimed {
+		t.Fatalf("Expected claim after release to succeed.")
+	}
+	if err := st.Commit("frame-1", time.Minute); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if state, _ := st.Claim("frame-1", time.Minute); state != Committed {
+		t.Fatalf("actual=%d expected=%d\n", state, Committed)
+	}
+}
+
+func TestRedisLatePut(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+
+	ts := time.Now().Add(-2 * time.Minute).Truncate(time.Minute)
+	id := &bucket.Id{
+		Name:       "test",
+		Time:       ts,
+		Resolution: time.Minute,
+		ReadyAt:    ts.Add(time.Minute),
+	}
+	st.Put(&bucket.Bucket{Id: id, Vals: []float64{1, 2}}, time.Now())
+	// The bucket's ReadyAt has passed so it is
+	// scheduled for the next second.
+	next := time.Now().Truncate(time.Second).Add(time.Second)
+	bchan, err := st.Scan(next)
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var buckets []*bucket.Bucket
+	for b := range bchan {
+		buckets = append(buckets, b)
+	}
+	if len(buckets) != 1 {
+		t.Fatalf("expected=1 actual=%d\n", len(buckets))
+	}
+	st.Put(&bucket.Bucket{Id: id, Vals: []float64{3}}, time.Now())
+	if err := st.Get(buckets[0]); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if buckets[0].Count() != 3 {
+		t.Fatalf("expected=3 actual=%d\n", buckets[0].Count())
+	}
+}
+
+// The local clock is an hour behind the store. A bucket that is
+// late by the store's time must be read by a reader on time.
+func TestRedisPutSkewedClock(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	cfg.Clock = clock.NewSim(time.Now().Add(-time.Hour))
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+	c := NewClock(cfg, st)
+	c.Mchan = new(metchan.Channel)
+	c.Start()
+	defer c.Stop()
+
+	ts := time.Now().Add(-2 * time.Minute).Truncate(time.Minute)
+	id := &bucket.Id{
+		Name:       "test",
+		Time:       ts,
+		Resolution: time.Minute,
+		ReadyAt:    ts.Add(time.Minute),
+	}
+	if err := st.Put(&bucket.Bucket{Id: id, Vals: []float64{1}}, c.Now()); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	next := c.Now().Truncate(time.Second).Add(time.Second)
+	bchan, err := st.Scan(next)
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var n int
+	for _ = range bchan {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected=1 actual=%d\n", n)
+	}
+}
+
+func TestRedisPutSketch(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+	id := &bucket.Id{Name: "hot"}
+	b1 := &bucket.Bucket{Id: id}
+	for i := 0; i < 100000; i++ {
+		b1.Append(float64(i % 1000))
+	}
+	st.Put(b1, time.Now())
+	st.Put(&bucket.Bucket{Id: id, Vals: []float64{2000}}, time.Now())
+
+	rc := st.redisPool.Get()
+	defer rc.Close()
+	key, _ := id.Encode()
+	n, err := redis.Int(rc.Do("LLEN", key))
+	if err != nil || n != 2 {
+		t.Fatalf("actual-entries=%d expected-entries=2 error=%v\n", n, err)
+	}
+	// Legacy entries are still read.
+	rc.Do("RPUSH", key, "3.0000000000")
+
+	b2 := &bucket.Bucket{Id: id}
+	if err := st.Get(b2); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if b2.Count() != 100002 || b2.Max() != 2000 || b2.Last() != 3 {
+		t.Fatalf("actual=%d,%f,%f\n", b2.Count(), b2.Max(), b2.Last())
+	}
+}
@@ -8,11 +8,61 @@ import (
 	"time"
 )
 
+// Buckets are kept in the store for this long after they are
+// written so that late data can be merged into a corrected bucket.
+const Retention = 5 * time.Minute
+
+// The state of a key recorded by Claim.
+type ClaimState int
+
+const (
+	// The key was not recorded and has been recorded as pending.
+	Claimed ClaimState = iota
+	// The request that recorded the key is still being handled.
+	Pending
+	// The request that recorded the key was accepted.
+	Committed
+)
+
 type Store interface {
 	MaxPartitions() uint64
-	Put(*bucket.Bucket) error
+	// Writes the bucket. Now is the store's time, which decides
+	// the partition of a bucket whose ReadyAt has passed.
+	Put(b *bucket.Bucket, now time.Time) error
 	Get(*bucket.Bucket) error
 	Scan(time.Time) (<-chan *bucket.Bucket, error)
-	Now() time.Time
+	// Reads the store's time, which is shared by all receivers
+	// and readers. Callers should use a Clock rather than a
+	// round trip to the store for every read.
+	Now() (time.Time, error)
+	// Records key as pending for the duration of ttl. Returns Claimed
+	// if the key was recorded by this call, otherwise the state the
+	// key was already in. Receivers use this to drop retried requests.
+	Claim(key string, ttl time.Duration) (ClaimState, error)
+	// Marks a key recorded by Claim as committed for the duration of ttl.
+	Commit(key string, ttl time.Duration) error
+	// Removes a key recorded by Claim.
+	Release(key string) error
+	// Replaces the running totals of keys with the totals returned
+	// by next, which is given the previous totals. Present is false
+	// for a key without a total. The totals are kept for ttl. The
+	// buckets returned by next are written in the same update as the
+	// totals, so either both are kept or neither is. Now is the store's
+	// time, as given to Put. The update is atomic across receivers, so
+	// next may be called more than once. Only the totals and buckets
+	// of its last call are kept.
+	UpdateTotals(keys []string, ttl time.Duration, now time.Time, next func(prev []float64, present []bool) ([]float64, []*bucket.Bucket)) error
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
+
+// Returns the time at which a bucket should be read from the store.
+// Readers scan by the store's time, so now must be the store's time.
+// If the bucket's ReadyAt has passed, the bucket's interval has
+// already been read. We schedule the bucket for the next second
+// and the reader will emit a corrected bucket for the interval.
+func schedule(id *bucket.Id, now time.Time) time.Time {
+	if id.ReadyAt.Unix() < now.Unix() {
+		return now.Truncate(time.Second).Add(time.Second)
+	}
+	return id.ReadyAt
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+	"sort"
+	"time"
+)
+
+// The last total of a series is forgotten once the
+// series has not been seen for this long.
+const TotalRetention = 24 * time.Hour
+
+// A total that falls below this fraction of the previous total
+// means the process keeping the total restarted. Smaller decreases
+// are totals that arrived out of order and have been counted.
+const ResetRatio = 0.5
+
+// Converts buckets of running totals (e.g. total#requests=182733)
+// into counters of the increase since the previous total of each
+// series. The last total of a series is kept in the store so that
+// it survives receiver restarts. The totals of a series are taken
+// in the order of their buckets' times, then in the order they were
+// logged. Totals that go backwards are dropped, unless they fall far
+// enough to be a reset, which counts the total itself. The first
+// total of a series has no increase. Buckets that are left with
+// nothing to count have no Vals. The store is updated once for
+// all of the buckets.
+func Deltas(st Store, buckets []*bucket.Bucket) error {
+	return deltas(st, buckets, false, time.Time{})
+}
+
+// Like Deltas, but the counters with something to count are also
+// written to the store, in the same update as the totals. If the
+// write fails the totals are left as they were, so the buckets can
+// be converted again without losing the increase. Now is the
+// store's time.
+func PutDeltas(st Store, buckets []*bucket.Bucket, now time.Time) error {
+	return deltas(st, buckets, true, now)
+}
+
+func deltas(st Store, buckets []*bucket.Bucket, put bool, now time.Time) error {
+	series := make(map[string][]*bucket.Bucket)
+	var keys []string
+	for _, b := range buckets {
+		k := totalKey(b.Id)
+		if _, ok := series[k]; !ok {
+			keys = append(keys, k)
+		}
+		series[k] = append(series[k], b)
+	}
+	for _, k := range keys {
+		sort.Stable(bucket.ByTime(series[k]))
+	}
+	// The totals are replaced by the deltas, which next
+	// may compute more than once.
+	totals := make(map[*bucket.Bucket][]float64, len(buckets))
+	for _, b := range buckets {
+		totals[b] = b.Vals
+	}
+	return st.UpdateTotals(keys, TotalRetention, now, func(prev []float64, present []bool) ([]float64, []*bucket.Bucket) {
+		next := make([]float64, len(keys))
+		var counted []*bucket.Bucket
+		for i, k := range keys {
+			last, seen := prev[i], present[i]
+			for _, b := range series[k] {
+				var ds []float64
+				for _, v := range totals[b] {
+					d, ok := delta(last, seen, v)
+					if ok {
+						ds = append(ds, d)
+					}
+					if ok || !seen {
+						last, seen = v, true
+					}
+				}
+				b.Lock()
+				b.Vals = ds
+				b.Id.Type = "counter"
+				b.Unlock()
+				if put && len(ds) > 0 {
+					counted = append(counted, b)
+				}
+			}
+			next[i] = last
+		}
+		return next, counted
+	})
+}
+
+// Returns the increase from the previous total to v. Returns false
+// if there is no previous total or v went backwards.
+func delta(prev float64, present bool, v float64) (float64, bool) {
+	switch {
+	case !present:
+		return 0, false
+	case v >= prev:
+		return v - prev, true
+	case v < prev*ResetRatio:
+		return v, true
+	}
+	return 0, false
+}
+
+// Drain tokens are long, so the key is a digest of the series.
+func totalKey(id *bucket.Id) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", id.Auth, id.Name, id.Source)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"github.com/ryandotsmith/l2met/bucket"
+	"github.com/ryandotsmith/l2met/conf"
+	"github.com/ryandotsmith/l2met/metchan"
+	"testing"
+	"time"
+)
+
+var deltasTest = []struct {
+	desc   string
+	totals []float64
+	deltas []float64
+}{
+	{"first", []float64{100}, nil},
+	{"increase", []float64{150}, []float64{50}},
+	{"unchanged", []float64{150}, []float64{0}},
+	{"reset", []float64{20}, []float64{20}},
+	{"many", []float64{25, 40}, []float64{5, 15}},
+	// Totals that arrived out of order were already counted.
+	{"backwards", []float64{35, 50}, []float64{10}},
+}
+
+func testDeltas(t *testing.T, st Store) {
+	for _, ts := range deltasTest {
+		id := &bucket.Id{Auth: "abc", Name: "requests", Source: "web.1", Type: "total"}
+		b := &bucket.Bucket{Id: id, Vals: ts.totals}
+		if err := Deltas(st, []*bucket.Bucket{b}); err != nil {
+			t.Fatalf("case=%s error=%s\n", ts.desc, err)
+		}
+		if len(b.Vals) != len(ts.deltas) {
+			t.Fatalf("case=%s actual=%v expected=%v\n", ts.desc, b.Vals, ts.deltas)
+		}
+		for i := range ts.deltas {
+			if b.Vals[i] != ts.deltas[i] {
+				t.Fatalf("case=%s actual=%v expected=%v\n", ts.desc, b.Vals, ts.deltas)
+			}
+		}
+		if b.Id.Type != "counter" {
+			t.Fatalf("case=%s actual-type=%s expected-type=counter\n", ts.desc, b.Id.Type)
+		}
+	}
+	// Other sources of the same name have their own total.
+	id := &bucket.Id{Auth: "abc", Name: "requests", Source: "web.2", Type: "total"}
+	b := &bucket.Bucket{Id: id, Vals: []float64{1000}}
+	if Deltas(st, []*bucket.Bucket{b}); len(b.Vals) != 0 {
+		t.Fatalf("Expected the first total of web.2 to have no delta.")
+	}
+}
+
+func TestMemStoreDeltas(t *testing.T) {
+	testDeltas(t, NewMemStore())
+}
+
+func TestRedisDeltas(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+	testDeltas(t, st)
+
+	// A new store, as used by a restarted receiver,
+	// remembers the totals.
+	restarted := NewRedisStore(cfg)
+	restarted.Mchan = new(metchan.Channel)
+	id := &bucket.Id{Auth: "abc", Name: "requests", Source: "web.1", Type: "total"}
+	b := &bucket.Bucket{Id: id, Vals: []float64{60}}
+	err := Deltas(restarted, []*bucket.Bucket{b})
+	if err != nil || len(b.Vals) != 1 || b.Vals[0] != 10 {
+		t.Fatalf("actual=%v error=%v expected=[10]\n", b.Vals, err)
+	}
+}
+
+// Requests that arrive out of order, e.g. from concurrent
+// posts, count the increase between the lowest and highest total.
+func TestDeltasOutOfOrder(t *testing.T) {
+	st := NewMemStore()
+	var sum float64
+	for _, total := range []float64{100000, 100020, 100010, 100030} {
+		id := &bucket.Id{Auth: "abc", Name: "requests", Type: "total"}
+		b := &bucket.Bucket{Id: id, Vals: []float64{total}}
+		if err := Deltas(st, []*bucket.Bucket{b}); err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+		sum += b.Sum()
+	}
+	if sum != 30 {
+		t.Fatalf("actual=%f expected=30\n", sum)
+	}
+}
+
+// The buckets of a series are taken in time order, whatever
+// order they were given in.
+func TestDeltasByTime(t *testing.T) {
+	st := NewMemStore()
+	ts := time.Now().Truncate(time.Minute)
+	var buckets []*bucket.Bucket
+	for i, total := range []float64{300, 200, 100} {
+		id := &bucket.Id{Auth: "abc", Name: "requests", Type: "total",
+			Time: ts.Add(time.Duration(2-i) * time.Minute)}
+		buckets = append(buckets, &bucket.Bucket{Id: id, Vals: []float64{total}})
+	}
+	if err := Deltas(st, buckets); err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	if len(buckets[2].Vals) != 0 || buckets[1].Sum() != 100 || buckets[0].Sum() != 100 {
+		t.Fatalf("actual=%v,%v,%v expected=[],[100],[100]\n",
+			buckets[0].Vals, buckets[1].Vals, buckets[2].Vals)
+	}
+}
+
+// Each update sees the totals written by the others.
+func TestRedisUpdateTotalsConcurrent(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379", Concurrency: 4}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			errs <- st.UpdateTotals([]string{"k"}, time.Minute, time.Now(), func(prev []float64, present []bool) ([]float64, []*bucket.Bucket) {
+				return []float64{prev[0] + 1}, nil
+			})
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+	}
+	var actual float64
+	st.UpdateTotals([]string{"k"}, time.Minute, time.Now(), func(prev []float64, present []bool) ([]float64, []*bucket.Bucket) {
+		actual = prev[0]
+		return prev, nil
+	})
+	if actual != 4 {
+		t.Fatalf("actual=%f expected=4\n", actual)
+	}
+}
+
+// The counters are written with the totals.
+func TestRedisPutDeltas(t *testing.T) {
+	cfg := &conf.D{MaxPartitions: 1, RedisHost: "localhost:6379"}
+	st := NewRedisStore(cfg)
+	st.Mchan = new(metchan.Channel)
+	st.Flush()
+	ts := time.Now().Truncate(time.Minute)
+	for _, v := range []float64{100, 150} {
+		id := &bucket.Id{Auth: "abc", Name: "requests", Type: "total",
+			Time: ts, Resolution: time.Minute, ReadyAt: ts.Add(time.Minute)}
+		b := &bucket.Bucket{Id: id, Vals: []float64{v}}
+		if err := PutDeltas(st, []*bucket.Bucket{b}, time.Now()); err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+	}
+	bchan, err := st.Scan(ts.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("error=%s\n", err)
+	}
+	var sum float64
+	var n int
+	for b := range bchan {
+		if err := st.Get(b); err != nil {
+			t.Fatalf("error=%s\n", err)
+		}
+		if b.Id.Type != "counter" {
+			t.Fatalf("actual-type=%s expected-type=counter\n", b.Id.Type)
+		}
+		sum += b.Sum()
+		n++
+	}
+	if n != 1 || sum != 50 {
+		t.Fatalf("actual=%d,%f expected=1,50\n", n, sum)
+	}
+}